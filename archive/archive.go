@@ -0,0 +1,219 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	appError "github.com/aleveille/tems/error"
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	archiveFileName = "archive.jsonl"
+
+	// Bodies bigger than this are truncated in the archive
+	maxBodySize = 1024 * 1024
+
+	// Headers that are never archived as-is
+	secretHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Circonus-Auth-Token"}
+
+	writer *rotatingWriter
+)
+
+// Entry is an archived request/response pair, one JSON object per line
+type Entry struct {
+	Time            time.Time   `json:"time"`
+	Client          string      `json:"client"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	RequestHeaders  http.Header `json:"requestHeaders,omitempty"`
+	RequestBody     string      `json:"requestBody,omitempty"`
+	Status          int         `json:"status,omitempty"`
+	ResponseHeaders http.Header `json:"responseHeaders,omitempty"`
+	ResponseBody    string      `json:"responseBody,omitempty"`
+	DurationMs      float64     `json:"durationMs"`
+	Error           string      `json:"error,omitempty"`
+}
+
+// rotatingWriter appends to the archive file and rotates it when it reaches config.ArchiveMaxFileSizeMB
+// The rotated files are archive.1.jsonl (most recent) to archive.<ArchiveMaxFiles>.jsonl
+type rotatingWriter struct {
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// Init opens the archive when config.ArchiveMode isn't off
+func Init() error {
+	log.Debug("archive Init() start")
+	defer log.Debug("archive Init() end")
+
+	if config.ArchiveMode == "off" {
+		return nil
+	}
+
+	err := os.MkdirAll(config.ArchiveDir, 0755)
+	if err != nil {
+		return appError.NewInitializationError("Error while creating the archive directory", err)
+	}
+
+	w := &rotatingWriter{}
+	err = w.open()
+	if err != nil {
+		return appError.NewInitializationError("Error while opening the archive file", err)
+	}
+
+	writer = w
+	log.Infof("Archiving the %s requests in %s", config.ArchiveMode, config.ArchiveDir)
+	return nil
+}
+
+// RecordHTTP archives the request/response pair if it matches config.ArchiveMode. The response and body can be nil
+// when the request failed. The request body is read again through req.GetBody, so the caller's copy isn't consumed.
+func RecordHTTP(client string, req *http.Request, response *http.Response, body []byte, duration time.Duration, requestErr error) {
+	if writer == nil {
+		return
+	}
+
+	failed := requestErr != nil || (response != nil && response.StatusCode >= 400)
+	switch config.ArchiveMode {
+	case "failed":
+		if !failed {
+			return
+		}
+	case "slow":
+		if !failed && duration < config.ArchiveSlowThreshold {
+			return
+		}
+	}
+
+	entry := Entry{
+		Time:           time.Now(),
+		Client:         client,
+		Method:         req.Method,
+		URL:            redact(req.URL.Redacted()),
+		RequestHeaders: redactHeaders(req.Header),
+		ResponseBody:   truncate(redact(string(body))),
+		DurationMs:     float64(duration.Nanoseconds()) / 1000 / 1000,
+	}
+	if req.GetBody != nil {
+		if requestBody, err := req.GetBody(); err == nil {
+			content, _ := ioutil.ReadAll(requestBody)
+			entry.RequestBody = truncate(redact(string(content)))
+		}
+	}
+	if response != nil {
+		entry.Status = response.StatusCode
+		entry.ResponseHeaders = redactHeaders(response.Header)
+	}
+	if requestErr != nil {
+		entry.Error = redact(requestErr.Error())
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Error while encoding the archive entry: %v", err)
+		return
+	}
+
+	err = writer.write(append(line, '\n'))
+	if err != nil {
+		log.Errorf("Error while writing to the archive: %v", err)
+	}
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(filepath.Join(config.ArchiveDir, archiveFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) write(line []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.size+int64(len(line)) > int64(config.ArchiveMaxFileSizeMB)*1024*1024 && w.size > 0 {
+		err := w.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+// rotate shifts the rotated files by one, dropping the oldest, and starts a new archive file
+func (w *rotatingWriter) rotate() error {
+	w.file.Close()
+
+	base := strings.TrimSuffix(archiveFileName, ".jsonl")
+	rotatedName := func(index int) string {
+		return filepath.Join(config.ArchiveDir, fmt.Sprintf("%s.%d.jsonl", base, index))
+	}
+
+	os.Remove(rotatedName(config.ArchiveMaxFiles))
+	for index := config.ArchiveMaxFiles - 1; index >= 1; index-- {
+		os.Rename(rotatedName(index), rotatedName(index+1))
+	}
+	err := os.Rename(filepath.Join(config.ArchiveDir, archiveFileName), rotatedName(1))
+	if err != nil {
+		return err
+	}
+
+	return w.open()
+}
+
+// redact removes the configured secrets (passwords, tokens, httptrap secret) from the archived text
+// The bodies are redacted before being truncated, a secret cut by the truncation wouldn't be found
+func redact(text string) string {
+	for _, secret := range []string{config.GrafanaPassword, config.GrafanaAPIToken, config.CirconusAPIToken, config.IRONdbCheckSecret} {
+		if secret != "" {
+			text = strings.Replace(text, secret, "REDACTED", -1)
+		}
+	}
+
+	return text
+}
+
+func redactHeaders(headers http.Header) http.Header {
+	redacted := http.Header{}
+	for name, values := range headers {
+		redacted[name] = values
+	}
+	for _, name := range secretHeaders {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, "REDACTED")
+		}
+	}
+
+	return redacted
+}
+
+func truncate(body string) string {
+	if len(body) <= maxBodySize {
+		return body
+	}
+
+	return body[:maxBodySize] + "...(truncated)"
+}
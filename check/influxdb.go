@@ -27,6 +27,26 @@ var (
 	influxdbQuery400TimeseriesP99  = `SELECT percentile("max", 99) FROM "1m"."randomint-1" WHERE ("worker" =~ /1[0-9]{2}/ AND "node" =~ /lg[0-4]/) AND time >= now() - %s GROUP BY time(5s)`
 	influxdbQuery100TimeseriesMean = `SELECT mean("mean") FROM "1m"."randomint-1" WHERE ("worker" =~ /1[0-9]{2}/ AND "node" = 'lg1') AND time >= now() - %s GROUP BY time(5s)`
 	influxdbQuery400TimeseriesMean = `SELECT mean("mean") FROM "1m"."randomint-1" WHERE ("worker" =~ /1[0-9]{2}/ AND "node" =~ /lg[0-4]/) AND time >= now() - %s GROUP BY time(5s)`
+	// Histogram buckets are stored Prometheus-style: one series per "le" tag with the cumulative bucket count as the field
+	// InfluxQL can't compute a quantile over buckets, so the p99 goes through Flux (config.GrafanaFluxDatasource)
+	influxdbQuery100HistogramP99 = `from(bucket: "mydb/autogen")
+									|> range(start: -%s)
+									|> filter(fn: (r) => r._measurement == "latency-histogram" and r._field == "count" and r.node == "lg1" and r.worker =~ /^1[0-9]{2}$/)
+									|> group(columns: ["le"])
+									|> aggregateWindow(every: 1m, fn: sum, createEmpty: false)
+									|> map(fn: (r) => ({r with le: float(v: r.le)}))
+									|> group(columns: ["_time"])
+									|> histogramQuantile(quantile: 0.99, countColumn: "_value", upperBoundColumn: "le", valueColumn: "_value")
+									|> group()`
+	influxdbQuery400HistogramP99 = `from(bucket: "mydb/autogen")
+									|> range(start: -%s)
+									|> filter(fn: (r) => r._measurement == "latency-histogram" and r._field == "count" and r.node =~ /^lg[0-4]$/ and r.worker =~ /^1[0-9]{2}$/)
+									|> group(columns: ["le"])
+									|> aggregateWindow(every: 1m, fn: sum, createEmpty: false)
+									|> map(fn: (r) => ({r with le: float(v: r.le)}))
+									|> group(columns: ["_time"])
+									|> histogramQuantile(quantile: 0.99, countColumn: "_value", upperBoundColumn: "le", valueColumn: "_value")
+									|> group()`
 )
 
 // EvaluateInfluxDB will launch the AWS and InfluxDB queries to assess InfluxDB performances
@@ -34,32 +54,18 @@ func EvaluateInfluxDB() {
 	log.Info("Starting the performance eval for InfluxDB")
 	ticker := time.Tick(60 * time.Second)
 
-	for {
-		metricQueries := []datasource.MetricQuery{
-			{AwsName: "CPUUtilization", ReportingName: "cpu.utilization.avg", Stat: "Average"},
-			{AwsName: "NetworkIn", ReportingName: "network.in.bytes", Stat: "Sum"},
-			{AwsName: "NetworkOut", ReportingName: "network.out.bytes", Stat: "Sum"},
+	if config.QuerySweep {
+		go sweepInfluxDB()
+	}
 
-			{AwsName: "DiskReadBytes", ReportingName: "disk.read.bytes", Stat: "Sum"},
-			{AwsName: "DiskWriteBytes", ReportingName: "disk.write.bytes", Stat: "Sum"},
+	for {
+		go collectInfraMetrics()
 
-			{AwsName: "EBSReadBytes", ReportingName: "ebs.read.bytes", Stat: "Sum"},
-			{AwsName: "EBSWriteBytes", ReportingName: "ebs.write.bytes", Stat: "Sum"},
-		}
-		dimensionQueries := []datasource.DimensionQuery{
-			{AwsName: "AutoScalingGroupName", ReportingName: "infra.tsdb-asg-", DimensionValues: datasource.AWSProxyInstance.AsgNames},
-			{AwsName: "InstanceId", ReportingName: "infra.tsdb-node-", DimensionValues: datasource.AWSProxyInstance.InstanceIDs},
+		if config.Canary {
+			go datasource.VisibilityCanary()
 		}
-		for _, metricQuery := range metricQueries {
-			for dimensionIndex, dimensionQuery := range dimensionQueries {
-				for _, dimensionValue := range dimensionQuery.DimensionValues {
-					dimensionReportingNameFormatted := fmt.Sprintf("%s%d", dimensionQuery.ReportingName, dimensionIndex+1)
-					metricFullname := fmt.Sprintf("%s.%s.%s", config.SandboxID, dimensionReportingNameFormatted, metricQuery.ReportingName)
-					if dimensionValue != "" {
-						go datasource.AWSProxyInstance.GrabAWSmetric(metricFullname, metricQuery.AwsName, "AWS/EC2", dimensionQuery.AwsName, dimensionValue, metricQuery.Stat)
-					}
-				}
-			}
+		if config.TSDBStats {
+			go datasource.CollectTSDBStats()
 		}
 		time.Sleep(2 * time.Second)
 
@@ -85,6 +91,19 @@ func EvaluateInfluxDB() {
 		time.Sleep(2 * time.Second)
 		go datasource.GrafanaProxyInstance.SimpleInfluxDBQuery("400-ts-mean-1-week-range", influxdbQuery400TimeseriesMean, "7d")
 
+		if config.HistogramScenarios {
+			time.Sleep(2 * time.Second)
+			go datasource.GrafanaProxyInstance.FluxDBQuery("histogram-100-ts-p99-24-hour-range", fmt.Sprintf(influxdbQuery100HistogramP99, "24h"))
+			time.Sleep(2 * time.Second)
+			go datasource.GrafanaProxyInstance.FluxDBQuery("histogram-100-ts-p99-1-week-range", fmt.Sprintf(influxdbQuery100HistogramP99, "7d"))
+			time.Sleep(2 * time.Second)
+			go datasource.GrafanaProxyInstance.FluxDBQuery("histogram-400-ts-p99-1-week-range", fmt.Sprintf(influxdbQuery400HistogramP99, "7d"))
+		}
+
+		if config.MetadataScenarios {
+			metadataInfluxDB()
+		}
+
 		select {
 		// Need a control channel here
 		case <-ticker:
@@ -0,0 +1,203 @@
+package check
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/datasource"
+
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	infraMetricQueries = []datasource.MetricQuery{
+		{AwsName: "CPUUtilization", ReportingName: "cpu.utilization.avg", Stat: "Average"},
+		{AwsName: "NetworkIn", ReportingName: "network.in.bytes", Stat: "Sum"},
+		{AwsName: "NetworkOut", ReportingName: "network.out.bytes", Stat: "Sum"},
+
+		{AwsName: "DiskReadBytes", ReportingName: "disk.read.bytes", Stat: "Sum"},
+		{AwsName: "DiskWriteBytes", ReportingName: "disk.write.bytes", Stat: "Sum"},
+
+		{AwsName: "EBSReadBytes", ReportingName: "ebs.read.bytes", Stat: "Sum"},
+		{AwsName: "EBSWriteBytes", ReportingName: "ebs.write.bytes", Stat: "Sum"},
+	}
+
+	// The CloudWatch agent metrics have more dimensions than the instance and ASG (eg: the filesystem path), so they are
+	// found with a SEARCH and aggregated with the function in Stat: the average memory and the fullest filesystem
+	cwAgentMetricQueries = []datasource.MetricQuery{
+		{AwsName: "mem_used_percent", ReportingName: "memory.utilization.avg", Stat: "AVG"},
+		{AwsName: "disk_used_percent", ReportingName: "disk.space.utilization.max", Stat: "MAX"},
+	}
+	cwAgentSearchExpression = `%s(SEARCH('Namespace="CWAgent" MetricName="%s" %s="%s"', 'Average', %d))`
+
+	// The ops are sums over the period, reported per second
+	ebsVolumeMetricQueries = []datasource.MetricQuery{
+		{AwsName: "VolumeQueueLength", ReportingName: "queue.length.avg", Stat: "Average"},
+		{AwsName: "VolumeReadOps", ReportingName: "read.iops.avg", Stat: "Sum"},
+		{AwsName: "VolumeWriteOps", ReportingName: "write.iops.avg", Stat: "Sum"},
+		{AwsName: "BurstBalance", ReportingName: "burst.balance.avg", Stat: "Average"},
+	}
+)
+
+// ExtendedInfraMetrics returns the names of the extended statistics of the EC2 averages (eg: cpu.utilization.p99),
+// relative to the ASG or node
+func ExtendedInfraMetrics() []string {
+	names := []string{}
+	for _, metricQuery := range extendedInfraMetricQueries() {
+		names = append(names, metricQuery.ReportingName)
+	}
+
+	return names
+}
+
+// extendedInfraMetricQueries returns a query per extended statistic (config.CloudWatchExtendedStatList) of each EC2
+// average. The dots of the statistic are replaced so it stays a single name segment (eg: p99.9 is reported as p99_9)
+func extendedInfraMetricQueries() []datasource.MetricQuery {
+	queries := []datasource.MetricQuery{}
+	for _, metricQuery := range infraMetricQueries {
+		if metricQuery.Stat != "Average" {
+			continue
+		}
+
+		for _, stat := range config.CloudWatchExtendedStatList {
+			queries = append(queries, datasource.MetricQuery{
+				AwsName:       metricQuery.AwsName,
+				ReportingName: strings.TrimSuffix(metricQuery.ReportingName, ".avg") + "." + strings.Replace(stat, ".", "_", -1),
+				Stat:          stat,
+			})
+		}
+	}
+
+	return queries
+}
+
+// Backfill pushes the CloudWatch history of the sandbox between from and to, eg: to fill the gaps of a past run
+// The ASGs and instances are the current ones, the terminated instances can't be discovered anymore
+func Backfill(from time.Time, to time.Time) {
+	log.Infof("Backfilling the CloudWatch metrics from %s to %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	datasource.AWSProxyInstance.BackfillCloudWatchMetrics(infraCloudWatchQueries(), from, to)
+}
+
+// collectInfraMetrics grabs the EC2 metrics of every ASG and instance of the sandbox in as few CloudWatch calls as possible
+// The ASGs and instances are discovered again first, so the replaced nodes are picked up on the next tick
+// Without CloudWatch, the node metrics come from node_exporter or Prometheus
+func collectInfraMetrics() {
+	if config.InfraSource != "cloudwatch" {
+		datasource.InfraProxyInstance.CollectInfraMetrics()
+		return
+	}
+
+	err := datasource.AWSProxyInstance.RefreshTopology()
+	if err != nil {
+		log.Errorf("Error while refreshing the sandbox ASGs, using the previous ones:\n%s\n", err)
+	}
+
+	datasource.AWSProxyInstance.CollectCloudWatchMetrics(infraCloudWatchQueries())
+}
+
+// infraCloudWatchQueries returns the CloudWatch queries of every ASG, instance and volume of the sandbox
+func infraCloudWatchQueries() []datasource.CloudWatchQuery {
+	asgNames, instanceIDs := datasource.AWSProxyInstance.Topology()
+	infraTags := datasource.AWSProxyInstance.InfraTags()
+	dimensionQueries := []datasource.DimensionQuery{
+		{AwsName: "AutoScalingGroupName", ReportingName: "infra.tsdb-asg-", DimensionValues: asgNames},
+		{AwsName: "InstanceId", ReportingName: "infra.tsdb-node-", DimensionValues: instanceIDs},
+	}
+
+	// The sums are reported per minute whatever the period, like the other infra sources
+	periodSeconds := int64(config.CloudWatchPeriod / time.Second)
+	sumScale := 60 / float64(periodSeconds)
+
+	queries := []datasource.CloudWatchQuery{}
+	for _, metricQuery := range append(append([]datasource.MetricQuery{}, infraMetricQueries...), extendedInfraMetricQueries()...) {
+		scale := 0.0
+		if metricQuery.Stat == "Sum" {
+			scale = sumScale
+		}
+
+		for _, dimensionQuery := range dimensionQueries {
+			for valueIndex, dimensionValue := range dimensionQuery.DimensionValues {
+				if dimensionValue == "" {
+					continue
+				}
+
+				// The ASGs and nodes are numbered from 1, like the metrics created in the check bundle
+				queries = append(queries, datasource.CloudWatchQuery{
+					ResultName:     fmt.Sprintf("%s.%s%d.%s", config.SandboxID, dimensionQuery.ReportingName, valueIndex+1, metricQuery.ReportingName),
+					Namespace:      "AWS/EC2",
+					MetricName:     metricQuery.AwsName,
+					DimensionName:  dimensionQuery.AwsName,
+					DimensionValue: dimensionValue,
+					Stat:           metricQuery.Stat,
+					Scale:          scale,
+					Tags:           infraTags[fmt.Sprintf("%s%d", dimensionQuery.ReportingName, valueIndex+1)],
+				})
+			}
+		}
+	}
+
+	if config.AWSCWAgentMetrics {
+		for _, metricQuery := range cwAgentMetricQueries {
+			for _, dimensionQuery := range dimensionQueries {
+				for valueIndex, dimensionValue := range dimensionQuery.DimensionValues {
+					if dimensionValue == "" {
+						continue
+					}
+
+					queries = append(queries, datasource.CloudWatchQuery{
+						ResultName:     fmt.Sprintf("%s.%s%d.%s", config.SandboxID, dimensionQuery.ReportingName, valueIndex+1, metricQuery.ReportingName),
+						Namespace:      "CWAgent",
+						MetricName:     metricQuery.AwsName,
+						DimensionName:  dimensionQuery.AwsName,
+						DimensionValue: dimensionValue,
+						Stat:           metricQuery.Stat,
+						Expression:     fmt.Sprintf(cwAgentSearchExpression, metricQuery.Stat, metricQuery.AwsName, dimensionQuery.AwsName, dimensionValue, periodSeconds),
+						Tags:           infraTags[fmt.Sprintf("%s%d", dimensionQuery.ReportingName, valueIndex+1)],
+					})
+				}
+			}
+		}
+	}
+
+	if config.AWSEBSVolumeMetrics {
+		volumes := datasource.AWSProxyInstance.Volumes()
+		for instanceIndex, instanceID := range instanceIDs {
+			for volumeIndex, volumeID := range volumes[instanceID] {
+				if volumeIndex >= config.AWSExpectedVolumesPerInstance {
+					break
+				}
+
+				// The volume type of the volume, instead of the ones of all the volumes of the node
+				nodeName := fmt.Sprintf("infra.tsdb-node-%d", instanceIndex+1)
+				volumeTags := append([]string{}, infraTags[fmt.Sprintf("%s.ebs-volume-%d", nodeName, volumeIndex+1)]...)
+				for _, tag := range infraTags[nodeName] {
+					if !strings.HasPrefix(tag, "volume-type: ") {
+						volumeTags = append(volumeTags, tag)
+					}
+				}
+
+				for _, metricQuery := range ebsVolumeMetricQueries {
+					scale := 0.0
+					if metricQuery.Stat == "Sum" {
+						scale = 1 / float64(periodSeconds)
+					}
+
+					queries = append(queries, datasource.CloudWatchQuery{
+						ResultName:     fmt.Sprintf("%s.infra.tsdb-node-%d.ebs-volume-%d.%s", config.SandboxID, instanceIndex+1, volumeIndex+1, metricQuery.ReportingName),
+						Namespace:      "AWS/EBS",
+						MetricName:     metricQuery.AwsName,
+						DimensionName:  "VolumeId",
+						DimensionValue: volumeID,
+						Stat:           metricQuery.Stat,
+						Scale:          scale,
+						Tags:           volumeTags,
+					})
+				}
+			}
+		}
+	}
+
+	return queries
+}
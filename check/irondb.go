@@ -1,7 +1,6 @@
 package check
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/aleveille/tems/config"
@@ -21,6 +20,10 @@ var (
 	caqlQuery100TimeseriesMean = "find(%22lagrande.randomint-1.lg1.1%3F%3F%22)%7Cwindow%3Amean(1M)"
 	caqlQuery400TimeseriesMean = "find(%22%2Flagrande.randomint-1.lg%5B0-4%5D.1%5B0-9%5D%7B2%7D%2F%22)%7Cwindow%3Amean(1M)"
 
+	//find:histogram("lagrande.latency-histogram.lg1.1??")|histogram:merge()|histogram:percentile(99)
+	caqlQuery100HistogramP99 = "find%3Ahistogram(%22lagrande.latency-histogram.lg1.1%3F%3F%22)%7Chistogram%3Amerge()%7Chistogram%3Apercentile(99)"
+	caqlQuery400HistogramP99 = "find%3Ahistogram(%22%2Flagrande.latency-histogram.lg%5B0-4%5D.1%5B0-9%5D%7B2%7D%2F%22)%7Chistogram%3Amerge()%7Chistogram%3Apercentile(99)"
+
 	caqlQueryMetricCountTags   = "find(%22randomint-1%22%2C%22and(namespace%3Alagrande%2Cnode%3A%2Flg%5B0-4%5D%2F)%22)%7Ccount()"
 	caqlQuery1TimeserieTags    = "find(%22randomint-1%22%2C%22and(namespace%3Alagrande%2Cnode%3Alg1%2Cworker%3A1)%22)"
 	caqlQuery100TimeseriesTags = "find(%22randomint-1%22%2C%22and(namespace%3Alagrande%2Cnode%3Alg1%2Cworker%3A1%3F%3F)%22)"
@@ -30,6 +33,8 @@ var (
 	caqlQuery400TimeseriesP99Tags  = "find(%22randomint-1%22%2C%22and(namespace%3Alagrande%2Cnode%3A%2Flg%5B0-4%5D%2F%2Cworker%3A1%3F%3F)%22)%7Cwindow%3Apercentile(1M%2C%2099)"
 	caqlQuery100TimeseriesMeanTags = "find(%22randomint-1%22%2C%22and(namespace%3Alagrande%2Cnode%3Alg1%2Cworker%3A1%3F%3F)%22)%7Cwindow%3Amean(1M)"
 	caqlQuery400TimeseriesMeanTags = "find(%22randomint-1%22%2C%22and(namespace%3Alagrande%2Cnode%3A%2Flg%5B0-4%5D%2F%2Cworker%3A1%3F%3F)%22)%7Cwindow%3Amean(1M)"
+	caqlQuery100HistogramP99Tags   = "find%3Ahistogram(%22latency-histogram%22%2C%22and(namespace%3Alagrande%2Cnode%3Alg1%2Cworker%3A1%3F%3F)%22)%7Chistogram%3Amerge()%7Chistogram%3Apercentile(99)"
+	caqlQuery400HistogramP99Tags   = "find%3Ahistogram(%22latency-histogram%22%2C%22and(namespace%3Alagrande%2Cnode%3A%2Flg%5B0-4%5D%2F%2Cworker%3A1%3F%3F)%22)%7Chistogram%3Amerge()%7Chistogram%3Apercentile(99)"
 )
 
 // EvaluateIRONdb will launch the AWS and CAQL queries to assess IRONdb performances
@@ -47,34 +52,22 @@ func EvaluateIRONdb() {
 		caqlQuery400TimeseriesP99 = caqlQuery400TimeseriesP99Tags
 		caqlQuery100TimeseriesMean = caqlQuery100TimeseriesMeanTags
 		caqlQuery400TimeseriesMean = caqlQuery400TimeseriesMeanTags
+		caqlQuery100HistogramP99 = caqlQuery100HistogramP99Tags
+		caqlQuery400HistogramP99 = caqlQuery400HistogramP99Tags
 	}
 
-	for {
-		metricQueries := []datasource.MetricQuery{
-			{AwsName: "CPUUtilization", ReportingName: "cpu.utilization.avg", Stat: "Average"},
-			{AwsName: "NetworkIn", ReportingName: "network.in.bytes", Stat: "Sum"},
-			{AwsName: "NetworkOut", ReportingName: "network.out.bytes", Stat: "Sum"},
+	if config.QuerySweep {
+		go sweepIRONdb()
+	}
 
-			{AwsName: "DiskReadBytes", ReportingName: "disk.read.bytes", Stat: "Sum"},
-			{AwsName: "DiskWriteBytes", ReportingName: "disk.write.bytes", Stat: "Sum"},
+	for {
+		go collectInfraMetrics()
 
-			{AwsName: "EBSReadBytes", ReportingName: "ebs.read.bytes", Stat: "Sum"},
-			{AwsName: "EBSWriteBytes", ReportingName: "ebs.write.bytes", Stat: "Sum"},
-		}
-		dimensionQueries := []datasource.DimensionQuery{
-			{AwsName: "AutoScalingGroupName", ReportingName: "infra.tsdb-asg-", DimensionValues: datasource.AWSProxyInstance.AsgNames},
-			{AwsName: "InstanceId", ReportingName: "infra.tsdb-node-", DimensionValues: datasource.AWSProxyInstance.InstanceIDs},
+		if config.Canary {
+			go datasource.VisibilityCanary()
 		}
-		for _, metricQuery := range metricQueries {
-			for dimensionIndex, dimensionQuery := range dimensionQueries {
-				for _, dimensionValue := range dimensionQuery.DimensionValues {
-					dimensionReportingNameFormatted := fmt.Sprintf("%s%d", dimensionQuery.ReportingName, dimensionIndex+1)
-					metricFullname := fmt.Sprintf("%s.%s.%s", config.SandboxID, dimensionReportingNameFormatted, metricQuery.ReportingName)
-					if dimensionValue != "" {
-						go datasource.AWSProxyInstance.GrabAWSmetric(metricFullname, metricQuery.AwsName, "AWS/EC2", dimensionQuery.AwsName, dimensionValue, metricQuery.Stat)
-					}
-				}
-			}
+		if config.TSDBStats {
+			go datasource.CollectTSDBStats()
 		}
 		time.Sleep(2 * time.Second)
 
@@ -100,6 +93,19 @@ func EvaluateIRONdb() {
 		time.Sleep(2 * time.Second)
 		go datasource.GrafanaProxyInstance.SimpleCaqlQuery("400-ts-mean-1-week-range", caqlQuery400TimeseriesMean, int64(60*60*24*7))
 
+		if config.HistogramScenarios {
+			time.Sleep(2 * time.Second)
+			go datasource.GrafanaProxyInstance.SimpleCaqlQuery("histogram-100-ts-p99-24-hour-range", caqlQuery100HistogramP99, int64(60*60*24))
+			time.Sleep(2 * time.Second)
+			go datasource.GrafanaProxyInstance.SimpleCaqlQuery("histogram-100-ts-p99-1-week-range", caqlQuery100HistogramP99, int64(60*60*24*7))
+			time.Sleep(2 * time.Second)
+			go datasource.GrafanaProxyInstance.SimpleCaqlQuery("histogram-400-ts-p99-1-week-range", caqlQuery400HistogramP99, int64(60*60*24*7))
+		}
+
+		if config.MetadataScenarios {
+			metadataIRONdb()
+		}
+
 		select {
 		// Need a control channel here
 		case <-ticker:
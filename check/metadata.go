@@ -0,0 +1,82 @@
+package check
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/datasource"
+)
+
+var (
+	metadataQueryMetrics = []string{
+		"metadata-tag-keys",
+		"metadata-tag-values",
+		"metadata-series-find-100-ts",
+		"metadata-series-find-400-ts",
+	}
+
+	irondbFindTagKeys         = "and(__name:lagrande.randomint-1.lg1.*)"
+	irondbFindTagValues       = "and(__name:lagrande.randomint-1.lg1.*)"
+	irondbFindTagValuesParams = url.Values{"category": {"__name"}}
+	irondbFind100Timeseries   = "and(__name:lagrande.randomint-1.lg1.1??)"
+	irondbFind400Timeseries   = "and(__name:/lagrande\\.randomint-1\\.lg[0-4]\\.1[0-9]{2}/)"
+
+	irondbFindTagKeysTags         = "and(__name:randomint-1,namespace:lagrande)"
+	irondbFindTagValuesTags       = "and(__name:randomint-1,namespace:lagrande)"
+	irondbFindTagValuesParamsTags = url.Values{"category": {"worker"}}
+	irondbFind100TimeseriesTags   = "and(__name:randomint-1,namespace:lagrande,node:lg1,worker:1??)"
+	irondbFind400TimeseriesTags   = "and(__name:randomint-1,namespace:lagrande,node:/lg[0-4]/,worker:1??)"
+
+	influxdbMetadataTagKeys           = `SHOW TAG KEYS FROM "1m"."randomint-1"`
+	influxdbMetadataTagValues         = `SHOW TAG VALUES FROM "1m"."randomint-1" WITH KEY = "worker"`
+	influxdbMetadataFind100Timeseries = `SHOW SERIES FROM "1m"."randomint-1" WHERE "worker" =~ /1[0-9]{2}/ AND "node" = 'lg1'`
+	influxdbMetadataFind400Timeseries = `SHOW SERIES FROM "1m"."randomint-1" WHERE "worker" =~ /1[0-9]{2}/ AND "node" =~ /lg[0-4]/`
+
+	// Timescale tags are table columns, hence the information_schema lookup for the tag keys
+	timescaleMetadataTagKeys           = `SELECT column_name FROM information_schema.columns WHERE table_name = 'randomint1'`
+	timescaleMetadataTagValues         = `SELECT DISTINCT worker FROM \"randomint1\" WHERE $__timeFilter(\"time\")`
+	timescaleMetadataFind100Timeseries = `SELECT DISTINCT worker FROM \"randomint1\" WHERE $__timeFilter(\"time\") AND worker SIMILAR TO '1[0-9][0-9]'`
+	timescaleMetadataFind400Timeseries = `SELECT DISTINCT worker FROM \"randomint1\" WHERE $__timeFilter(\"time\") AND worker SIMILAR TO '[1-4][0-9][0-9]'`
+)
+
+// metadataIRONdb will launch the IRONdb find queries, each spaced by 2 seconds
+func metadataIRONdb() {
+	tagKeys, tagValues, tagValuesParams, find100, find400 := irondbFindTagKeys, irondbFindTagValues, irondbFindTagValuesParams, irondbFind100Timeseries, irondbFind400Timeseries
+	if config.CAQLUseTags {
+		tagKeys, tagValues, tagValuesParams, find100, find400 = irondbFindTagKeysTags, irondbFindTagValuesTags, irondbFindTagValuesParamsTags, irondbFind100TimeseriesTags, irondbFind400TimeseriesTags
+	}
+
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.IRONdbFindQuery("metadata-tag-keys", "tag_cats", tagKeys, nil)
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.IRONdbFindQuery("metadata-tag-values", "tag_vals", tagValues, tagValuesParams)
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.IRONdbFindQuery("metadata-series-find-100-ts", "tags", find100, nil)
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.IRONdbFindQuery("metadata-series-find-400-ts", "tags", find400, nil)
+}
+
+// metadataInfluxDB will launch the InfluxQL SHOW queries, each spaced by 2 seconds
+func metadataInfluxDB() {
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.InfluxDBMetadataQuery("metadata-tag-keys", influxdbMetadataTagKeys)
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.InfluxDBMetadataQuery("metadata-tag-values", influxdbMetadataTagValues)
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.InfluxDBMetadataQuery("metadata-series-find-100-ts", influxdbMetadataFind100Timeseries)
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.InfluxDBMetadataQuery("metadata-series-find-400-ts", influxdbMetadataFind400Timeseries)
+}
+
+// metadataTimescaleDB will launch the Timescale SELECT DISTINCT queries, each spaced by 2 seconds
+func metadataTimescaleDB() {
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.TimescaleDBMetadataQuery("metadata-tag-keys", timescaleMetadataTagKeys, int64(60*60*24))
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.TimescaleDBMetadataQuery("metadata-tag-values", timescaleMetadataTagValues, int64(60*60*24))
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.TimescaleDBMetadataQuery("metadata-series-find-100-ts", timescaleMetadataFind100Timeseries, int64(60*60*24))
+	time.Sleep(2 * time.Second)
+	go datasource.GrafanaProxyInstance.TimescaleDBMetadataQuery("metadata-series-find-400-ts", timescaleMetadataFind400Timeseries, int64(60*60*24))
+}
@@ -0,0 +1,33 @@
+package check
+
+import (
+	"github.com/aleveille/tems/config"
+)
+
+var (
+	histogramQueryMetrics = []string{
+		"histogram-100-ts-p99-24-hour-range",
+		"histogram-100-ts-p99-1-week-range",
+		"histogram-400-ts-p99-1-week-range",
+	}
+)
+
+// OptionalQueryMetrics returns the query metric names of the optional scenarios enabled in the configuration
+// They need to be registered with dataout.RegisterQueryMetrics() before the Circonus check bundle gets created
+func OptionalQueryMetrics() []string {
+	names := []string{}
+
+	if config.QuerySweep {
+		names = append(names, sweepQueryMetrics()...)
+	}
+
+	if config.HistogramScenarios {
+		names = append(names, histogramQueryMetrics...)
+	}
+
+	if config.MetadataScenarios {
+		names = append(names, metadataQueryMetrics...)
+	}
+
+	return names
+}
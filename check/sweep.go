@@ -0,0 +1,119 @@
+package check
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/datasource"
+
+	log "github.com/aleveille/tems/logger"
+)
+
+// sweepScenario is a query that gets replayed over every configured range and step
+// The query string format is specific to each TSDB (see the sweep* functions below)
+type sweepScenario struct {
+	name  string
+	query string
+}
+
+var (
+	sweepScenarioNames = []string{"100-ts", "100-ts-mean", "100-ts-p99"}
+
+	// The InfluxQL sweep queries take two %s verbs: the range and the GROUP BY time() step
+	influxdbSweepScenarios = []sweepScenario{
+		{name: "100-ts", query: `SELECT last("mean") FROM "1m"."randomint-1" WHERE ("worker" =~ /1[0-9]{2}/ AND "node" = 'lg1') AND time >= now() - %s GROUP BY time(%s)`},
+		{name: "100-ts-mean", query: `SELECT mean("mean") FROM "1m"."randomint-1" WHERE ("worker" =~ /1[0-9]{2}/ AND "node" = 'lg1') AND time >= now() - %s GROUP BY time(%s)`},
+		{name: "100-ts-p99", query: `SELECT percentile("max", 99) FROM "1m"."randomint-1" WHERE ("worker" =~ /1[0-9]{2}/ AND "node" = 'lg1') AND time >= now() - %s GROUP BY time(%s)`},
+	}
+
+	timescaleSweepScenarios = []sweepScenario{
+		{name: "100-ts", query: timescaleQuery100Timeseries},
+		{name: "100-ts-mean", query: timescaleQuery100TimeseriesMean},
+		{name: "100-ts-p99", query: timescaleQuery100TimeseriesP99},
+	}
+)
+
+// sweepQueryMetrics returns the query metric names produced by the sweep scenarios for the configured ranges and steps
+func sweepQueryMetrics() []string {
+	names := []string{}
+
+	for _, scenarioName := range sweepScenarioNames {
+		for _, queryRange := range config.QuerySweepRangeDurations {
+			for _, step := range config.QuerySweepStepDurations {
+				names = append(names, sweepQueryMetricName(scenarioName, queryRange, step))
+			}
+		}
+	}
+
+	return names
+}
+
+// sweepQueryMetricName formats the metric name of a sweep query, eg: sweep-100-ts-mean-30-day-range-300s-step
+func sweepQueryMetricName(scenarioName string, queryRange time.Duration, step time.Duration) string {
+	return fmt.Sprintf("sweep-%s-%s-range-%ds-step", scenarioName, durationLabel(queryRange), int64(step.Seconds()))
+}
+
+// durationLabel formats a duration the same way the regular query metric names do (eg: 6-hour, 7-day)
+func durationLabel(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%d-day", int64(d/(24*time.Hour)))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%d-hour", int64(d/time.Hour))
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%d-minute", int64(d/time.Minute))
+	default:
+		return fmt.Sprintf("%d-second", int64(d/time.Second))
+	}
+}
+
+// sweep will call queryFunc for every scenario, range and step combination, forever
+// Each query is spaced by 2 seconds, like the regular queries
+func sweep(scenarios []sweepScenario, queryFunc func(metricName string, query string, queryRange time.Duration, step time.Duration)) {
+	log.Infof("Starting the query sweep over ranges %v and steps %v", config.QuerySweepRangeDurations, config.QuerySweepStepDurations)
+
+	for pass := 1; ; pass++ {
+		datasource.Annotate("phase", fmt.Sprintf("Query sweep pass %d started", pass))
+		for _, scenario := range scenarios {
+			for _, queryRange := range config.QuerySweepRangeDurations {
+				for _, step := range config.QuerySweepStepDurations {
+					go queryFunc(sweepQueryMetricName(scenario.name, queryRange, step), scenario.query, queryRange, step)
+					time.Sleep(2 * time.Second)
+				}
+			}
+		}
+		log.Trace("Query sweep pass completed")
+	}
+}
+
+func sweepIRONdb() {
+	// Built here rather than as a package variable so it picks up the tag version of the queries (see EvaluateIRONdb)
+	caqlSweepScenarios := []sweepScenario{
+		{name: "100-ts", query: caqlQuery100Timeseries},
+		{name: "100-ts-mean", query: caqlQuery100TimeseriesMean},
+		{name: "100-ts-p99", query: caqlQuery100TimeseriesP99},
+	}
+
+	sweep(caqlSweepScenarios, func(metricName string, query string, queryRange time.Duration, step time.Duration) {
+		datasource.GrafanaProxyInstance.SweepCaqlQuery(metricName, query, int64(queryRange.Seconds()), int64(step.Seconds()))
+	})
+}
+
+func sweepInfluxDB() {
+	sweep(influxdbSweepScenarios, func(metricName string, query string, queryRange time.Duration, step time.Duration) {
+		// Bake the step in the query and leave the range verb for SimpleInfluxDBQuery
+		stepQuery := fmt.Sprintf(query, "%s", fmt.Sprintf("%ds", int64(step.Seconds())))
+		datasource.GrafanaProxyInstance.SimpleInfluxDBQuery(metricName, stepQuery, fmt.Sprintf("%ds", int64(queryRange.Seconds())))
+	})
+}
+
+func sweepTimescaleDB() {
+	sweep(timescaleSweepScenarios, func(metricName string, query string, queryRange time.Duration, step time.Duration) {
+		maxDataPoints := int64(queryRange / step)
+		if maxDataPoints < 1 {
+			maxDataPoints = 1
+		}
+		datasource.GrafanaProxyInstance.SweepTimescaleDBQuery(metricName, query, int64(queryRange.Seconds()), step.Milliseconds(), maxDataPoints)
+	})
+}
@@ -1,7 +1,6 @@
 package check
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/aleveille/tems/config"
@@ -24,6 +23,11 @@ var (
 	timescaleQuery400TimeseriesP99  = `SELECT $__timeGroupAlias(\"time\",$__interval), sum(value) AS \"value\" FROM \"randomint1\" WHERE $__timeFilter(\"time\") AND worker SIMILAR TO '[1-4][0-9][0-9]' GROUP BY time ORDER BY time`
 	timescaleQuery100TimeseriesMean = `SELECT $__timeGroupAlias(\"time\",$__interval), percentile_cont(0.95) WITHIN GROUP (ORDER BY value) FROM \"randomint1\" WHERE $__timeFilter(\"time\") AND worker SIMILAR TO '1[0-9][0-9]' GROUP BY time ORDER BY time`
 	timescaleQuery400TimeseriesMean = `SELECT $__timeGroupAlias(\"time\",$__interval), percentile_cont(0.95) WITHIN GROUP (ORDER BY value) FROM \"randomint1\" WHERE $__timeFilter(\"time\") AND worker SIMILAR TO '[1-4][0-9][0-9]' GROUP BY time ORDER BY time`
+	// Histogram buckets are stored one row per (time, worker, le) with the non-cumulative bucket count. The p99 is the
+	// upper bound of the first bucket where the cumulative count reaches 99% of the total. le can be a text column
+	// holding Prometheus bounds, so it is cast to float8 with '+Inf' mapped to 'Infinity' to sort numerically
+	timescaleQuery100HistogramP99 = `WITH buckets AS (SELECT $__timeGroup(\"time\",$__interval) AS \"time\", replace(le::text, '+Inf', 'Infinity')::float8 AS le, sum(count) AS count FROM \"latency_histogram\" WHERE $__timeFilter(\"time\") AND worker SIMILAR TO '1[0-9][0-9]' GROUP BY 1, 2), cumulative AS (SELECT \"time\", le, sum(count) OVER (PARTITION BY \"time\" ORDER BY le) AS cumulative_count, sum(count) OVER (PARTITION BY \"time\") AS total_count FROM buckets) SELECT \"time\", min(le) AS \"value\" FROM cumulative WHERE cumulative_count >= 0.99 * total_count GROUP BY \"time\" ORDER BY \"time\"`
+	timescaleQuery400HistogramP99 = `WITH buckets AS (SELECT $__timeGroup(\"time\",$__interval) AS \"time\", replace(le::text, '+Inf', 'Infinity')::float8 AS le, sum(count) AS count FROM \"latency_histogram\" WHERE $__timeFilter(\"time\") AND worker SIMILAR TO '[1-4][0-9][0-9]' GROUP BY 1, 2), cumulative AS (SELECT \"time\", le, sum(count) OVER (PARTITION BY \"time\" ORDER BY le) AS cumulative_count, sum(count) OVER (PARTITION BY \"time\") AS total_count FROM buckets) SELECT \"time\", min(le) AS \"value\" FROM cumulative WHERE cumulative_count >= 0.99 * total_count GROUP BY \"time\" ORDER BY \"time\"`
 )
 
 // EvaluateIRONdb will launch the AWS and timescale queries to assess IRONdb performances
@@ -31,32 +35,18 @@ func EvaluateTimescaleDB() {
 	log.Info("Starting the performance eval for TimescaleDB")
 	ticker := time.Tick(60 * time.Second)
 
-	for {
-		metricQueries := []datasource.MetricQuery{
-			{AwsName: "CPUUtilization", ReportingName: "cpu.utilization.avg", Stat: "Average"},
-			{AwsName: "NetworkIn", ReportingName: "network.in.bytes", Stat: "Sum"},
-			{AwsName: "NetworkOut", ReportingName: "network.out.bytes", Stat: "Sum"},
+	if config.QuerySweep {
+		go sweepTimescaleDB()
+	}
 
-			{AwsName: "DiskReadBytes", ReportingName: "disk.read.bytes", Stat: "Sum"},
-			{AwsName: "DiskWriteBytes", ReportingName: "disk.write.bytes", Stat: "Sum"},
+	for {
+		go collectInfraMetrics()
 
-			{AwsName: "EBSReadBytes", ReportingName: "ebs.read.bytes", Stat: "Sum"},
-			{AwsName: "EBSWriteBytes", ReportingName: "ebs.write.bytes", Stat: "Sum"},
-		}
-		dimensionQueries := []datasource.DimensionQuery{
-			{AwsName: "AutoScalingGroupName", ReportingName: "infra.tsdb-asg-", DimensionValues: datasource.AWSProxyInstance.AsgNames},
-			{AwsName: "InstanceId", ReportingName: "infra.tsdb-node-", DimensionValues: datasource.AWSProxyInstance.InstanceIDs},
+		if config.Canary {
+			go datasource.VisibilityCanary()
 		}
-		for _, metricQuery := range metricQueries {
-			for dimensionIndex, dimensionQuery := range dimensionQueries {
-				for _, dimensionValue := range dimensionQuery.DimensionValues {
-					dimensionReportingNameFormatted := fmt.Sprintf("%s%d", dimensionQuery.ReportingName, dimensionIndex+1)
-					metricFullname := fmt.Sprintf("%s.%s.%s", config.SandboxID, dimensionReportingNameFormatted, metricQuery.ReportingName)
-					if dimensionValue != "" {
-						go datasource.AWSProxyInstance.GrabAWSmetric(metricFullname, metricQuery.AwsName, "AWS/EC2", dimensionQuery.AwsName, dimensionValue, metricQuery.Stat)
-					}
-				}
-			}
+		if config.TSDBStats {
+			go datasource.CollectTSDBStats()
 		}
 		time.Sleep(2 * time.Second)
 		go datasource.GrafanaProxyInstance.TimescaleDBQuery("metrics-count", timescaleQueryMetricCount, int64(300))
@@ -81,6 +71,19 @@ func EvaluateTimescaleDB() {
 		time.Sleep(2 * time.Second)
 		go datasource.GrafanaProxyInstance.TimescaleDBQuery("400-ts-mean-1-week-range", timescaleQuery400TimeseriesMean, int64(60*60*24*7))
 
+		if config.HistogramScenarios {
+			time.Sleep(2 * time.Second)
+			go datasource.GrafanaProxyInstance.TimescaleDBQuery("histogram-100-ts-p99-24-hour-range", timescaleQuery100HistogramP99, int64(60*60*24))
+			time.Sleep(2 * time.Second)
+			go datasource.GrafanaProxyInstance.TimescaleDBQuery("histogram-100-ts-p99-1-week-range", timescaleQuery100HistogramP99, int64(60*60*24*7))
+			time.Sleep(2 * time.Second)
+			go datasource.GrafanaProxyInstance.TimescaleDBQuery("histogram-400-ts-p99-1-week-range", timescaleQuery400HistogramP99, int64(60*60*24*7))
+		}
+
+		if config.MetadataScenarios {
+			metadataTimescaleDB()
+		}
+
 		select {
 		// Need a control channel here
 		case <-ticker:
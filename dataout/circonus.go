@@ -2,13 +2,16 @@ package dataout
 
 import (
 	"fmt"
-	"net"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/aleveille/tems/config"
 	appError "github.com/aleveille/tems/error"
+	"github.com/aleveille/tems/httpclient"
 	log "github.com/aleveille/tems/logger"
 	circonusApi "github.com/circonus-labs/go-apiclient"
 )
@@ -41,9 +44,47 @@ var (
 		"network.out.bytes",
 		"disk.read.bytes",
 		"disk.write.bytes",
+	}
+
+	// cloudwatchInfraMetrics are only reported by the cloudwatch infra source, on top of infraMetrics
+	cloudwatchInfraMetrics = []string{
 		"ebs.read.bytes",
 		"ebs.write.bytes",
 	}
+
+	// cwAgentInfraMetrics are reported by the cloudwatch infra source with config.AWSCWAgentMetrics
+	cwAgentInfraMetrics = []string{
+		"memory.utilization.avg",
+		"disk.space.utilization.max",
+	}
+
+	// nodeExporterInfraMetrics are only reported by the node_exporter and prometheus infra sources, on top of infraMetrics
+	nodeExporterInfraMetrics = []string{
+		"memory.utilization.avg",
+	}
+
+	// infraVolumeMetrics are reported for each EBS volume of the nodes (ebs-volume-N.*) with config.AWSEBSVolumeMetrics
+	infraVolumeMetrics = []string{
+		"queue.length.avg",
+		"read.iops.avg",
+		"write.iops.avg",
+		"burst.balance.avg",
+	}
+
+	// localInfraMetrics are only reported by the local infra source, on top of infraMetrics
+	localInfraMetrics = []string{
+		"memory.rss.bytes",
+	}
+
+	// extendedInfraMetrics are the infraMetrics registered by RegisterInfraMetrics(), aggregated by the statistic
+	// ending their name (eg: cpu.utilization.p99)
+	extendedInfraMetrics = map[string]bool{}
+
+	// infraTags are the metadata tags of the infra metrics, by prefix (eg: infra.tsdb-node-3), see RegisterInfraTags()
+	infraTags = map[string][]string{}
+
+	// otherMetrics are registered by the optional features (eg: canary.visibility.duration), relative to the sandbox ID
+	otherMetrics = []string{}
 )
 
 // CirconusProxy is our wrapper to provide higher-level functionnality to the Circonus API
@@ -55,6 +96,76 @@ type CirconusProxy struct {
 	checkBundleID string
 }
 
+// RegisterQueryMetrics adds query metric names to the ones created in the check bundle.
+// This must be called before InitCirconusProxy()
+func RegisterQueryMetrics(names ...string) {
+	queryMetrics = append(queryMetrics, names...)
+}
+
+// RegisterQueryMetricSuffixes adds suffixes (eg: direct-duration) to the ones created for every query metric.
+// This must be called before InitCirconusProxy()
+func RegisterQueryMetricSuffixes(suffixes ...string) {
+	queryMetricSuffixes = append(queryMetricSuffixes, suffixes...)
+}
+
+// RegisterMetrics adds metric names (relative to the sandbox ID, eg: canary.visibility.duration) to the ones created in the check bundle.
+// This must be called before InitCirconusProxy()
+func RegisterMetrics(names ...string) {
+	otherMetrics = append(otherMetrics, names...)
+}
+
+// RegisterInfraMetrics adds metric names (relative to the ASG or node, eg: cpu.utilization.p99) to the infra ones created in the check bundle.
+// This must be called before InitCirconusProxy()
+func RegisterInfraMetrics(names ...string) {
+	infraMetrics = append(infraMetrics, names...)
+	for _, name := range names {
+		extendedInfraMetrics[name] = true
+	}
+}
+
+// RegisterInfraTags adds metadata tags (eg: "instance-type: r5.2xlarge") to the infra metrics starting with their
+// prefix (relative to the sandbox ID, eg: infra.tsdb-node-3).
+// This must be called before InitCirconusProxy()
+func RegisterInfraTags(tags map[string][]string) {
+	for prefix, prefixTags := range tags {
+		infraTags[prefix] = append(infraTags[prefix], prefixTags...)
+	}
+}
+
+// infraMetricTags returns the metadata tags of an infra metric (relative to the sandbox ID), eg: of its node and volume
+func infraMetricTags(metricName string) []string {
+	tagSet := map[string]bool{}
+	for prefix, prefixTags := range infraTags {
+		if strings.HasPrefix(metricName, prefix+".") {
+			for _, tag := range prefixTags {
+				tagSet[tag] = true
+			}
+		}
+	}
+
+	tags := make([]string, 0, len(tagSet))
+	for tag := range tagSet {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	return tags
+}
+
+// infraAggregation returns the aggregation tag of an infra metric
+func infraAggregation(metricName string) string {
+	switch {
+	case extendedInfraMetrics[metricName]:
+		return metricName[strings.LastIndex(metricName, ".")+1:]
+	case strings.Contains(metricName, ".avg"):
+		return "avg"
+	case strings.Contains(metricName, ".max"):
+		return "max"
+	default:
+		return "sum"
+	}
+}
+
 // InitCirconusProxy initialize the CirconusProxy struct in order to interact with Circonus' SaaS
 func InitCirconusProxy() (*CirconusProxy, error) {
 	log.Debug("InitCirconusProxy() start")
@@ -62,7 +173,14 @@ func InitCirconusProxy() (*CirconusProxy, error) {
 
 	proxy := CirconusProxy{}
 
-	circonusAPIclient, err := circonusApi.New(&circonusApi.Config{TokenKey: config.CirconusAPIToken})
+	// The go-apiclient builds its own transport: it gets the CA bundle and certificate verification setting, but it
+	// only honours the standard proxy variables, not -outboundProxy
+	tlsConfig := httpclient.TLSConfig()
+	circonusAPIclient, err := circonusApi.New(&circonusApi.Config{
+		TokenKey:  config.CirconusAPIToken,
+		CACert:    tlsConfig.RootCAs,
+		TLSConfig: tlsConfig,
+	})
 	if err != nil {
 		return &proxy, appError.NewInitializationError("error while initializing the Circonus API client", err)
 	}
@@ -86,23 +204,12 @@ func InitCirconusProxy() (*CirconusProxy, error) {
 }
 
 func circonusHTTPAPIclientSetup() *http.Client {
-	httpTransport := &http.Transport{
-		DisableCompression: true,
-		MaxConnsPerHost:    0,
-		Dial: (&net.Dialer{
-			Timeout: 200 * time.Millisecond,
-		}).Dial,
-		IdleConnTimeout:       200 * time.Millisecond,
-		ResponseHeaderTimeout: 500 * time.Millisecond,
-		TLSHandshakeTimeout:   500 * time.Millisecond,
-	}
-
-	circonusHTTPAPIclient := &http.Client{
-		Timeout:   1 * time.Second,
-		Transport: httpTransport,
-	}
-
-	return circonusHTTPAPIclient
+	return httpclient.New(httpclient.CirconusClient, httpclient.Settings{
+		Timeout:               config.HTTPCirconusTimeout,
+		DialTimeout:           200 * time.Millisecond,
+		ResponseHeaderTimeout: config.HTTPCirconusTimeout / 2,
+		TLSHandshakeTimeout:   config.HTTPCirconusTimeout / 2,
+	})
 }
 
 func (c *CirconusProxy) apiClientCheck() error {
@@ -170,7 +277,38 @@ func (c *CirconusProxy) createMetricsArray() ([]circonusApi.CheckBundleMetric, e
 	log.Trace("Circonus createAllMetrics() start (this takes about 2 minutes)")
 	defer log.Trace("Circonus createAllMetrics() end")
 
-	cBundleMetricArr := make([]circonusApi.CheckBundleMetric, len(queryMetrics)*2+len(infraMetrics)*(config.AWSExpectedASGs+config.AWSExpectedASGs*config.AWSExpectedInstanceCountPerASG))
+	// Without CloudWatch, there are no ASGs and the nodes are the ones listed in the config
+	asgCount := config.AWSExpectedASGs
+	nodeCount := config.AWSExpectedASGs * config.AWSExpectedInstanceCountPerASG
+	infraSource := "aws"
+	asgMetrics := append([]string{}, infraMetrics...)
+	switch config.InfraSource {
+	case "cloudwatch":
+		asgMetrics = append(asgMetrics, cloudwatchInfraMetrics...)
+		if config.AWSCWAgentMetrics {
+			asgMetrics = append(asgMetrics, cwAgentInfraMetrics...)
+		}
+	case "node_exporter", "prometheus":
+		asgMetrics = append(asgMetrics, nodeExporterInfraMetrics...)
+	case "local":
+		asgMetrics = append(asgMetrics, localInfraMetrics...)
+	}
+	if config.InfraSource != "cloudwatch" {
+		asgCount = 0
+		nodeCount = len(config.InfraNodeList)
+		infraSource = config.InfraSource
+	}
+	nodeMetrics := asgMetrics
+	if config.InfraSource == "cloudwatch" && config.AWSEBSVolumeMetrics {
+		nodeMetrics = append([]string{}, asgMetrics...)
+		for i := 1; i <= config.AWSExpectedVolumesPerInstance; i++ {
+			for _, metricName := range infraVolumeMetrics {
+				nodeMetrics = append(nodeMetrics, fmt.Sprintf("ebs-volume-%d.%s", i, metricName))
+			}
+		}
+	}
+
+	cBundleMetricArr := make([]circonusApi.CheckBundleMetric, len(queryMetrics)*len(queryMetricSuffixes)+len(asgMetrics)*asgCount+len(nodeMetrics)*nodeCount)
 	metricCount := 0
 
 	log.Tracef("Created a metric array %d wide", len(cBundleMetricArr))
@@ -189,17 +327,12 @@ func (c *CirconusProxy) createMetricsArray() ([]circonusApi.CheckBundleMetric, e
 	log.Tracef("Query metrics done, %d metrics created so far", metricCount)
 
 	for _, prefix := range infraAsgMetricPrefixes {
-		for i := 1; i <= config.AWSExpectedASGs; i++ {
-			for _, metricName := range infraMetrics {
+		for i := 1; i <= asgCount; i++ {
+			for _, metricName := range asgMetrics {
 				metricFullname := fmt.Sprintf("%s.%s%d.%s", config.SandboxID, prefix, i, metricName)
 
-				if strings.Contains(metricName, ".avg") {
-					tags = []string{fmt.Sprintf("sandbox: %s", config.SandboxID), "category: asg", "source: aws", "aggregation: avg"}
-				} else if strings.Contains(metricName, ".max") {
-					tags = []string{fmt.Sprintf("sandbox: %s", config.SandboxID), "category: asg", "source: aws", "aggregation: max"}
-				} else {
-					tags = []string{fmt.Sprintf("sandbox: %s", config.SandboxID), "category: asg", "source: aws", "aggregation: sum"}
-				}
+				tags = []string{fmt.Sprintf("sandbox: %s", config.SandboxID), "category: asg", "source: " + infraSource, "aggregation: " + infraAggregation(metricName)}
+				tags = append(tags, infraMetricTags(fmt.Sprintf("%s%d.%s", prefix, i, metricName))...)
 
 				cBundleMetricArr[metricCount] = *c.createMetric(metricFullname, tags)
 				metricCount++
@@ -209,17 +342,12 @@ func (c *CirconusProxy) createMetricsArray() ([]circonusApi.CheckBundleMetric, e
 	log.Tracef("ASG metrics done, %d metrics created so far", metricCount)
 
 	for _, prefix := range infraNodeMetricPrefixes {
-		for i := 1; i <= config.AWSExpectedASGs*config.AWSExpectedInstanceCountPerASG; i++ {
-			for _, metricName := range infraMetrics {
+		for i := 1; i <= nodeCount; i++ {
+			for _, metricName := range nodeMetrics {
 				metricFullname := fmt.Sprintf("%s.%s%d.%s", config.SandboxID, prefix, i, metricName)
 
-				if strings.Contains(metricName, ".avg") {
-					tags = []string{fmt.Sprintf("sandbox: %s", config.SandboxID), "category: asg", "source: aws", "aggregation: avg"}
-				} else if strings.Contains(metricName, ".max") {
-					tags = []string{fmt.Sprintf("sandbox: %s", config.SandboxID), "category: asg", "source: aws", "aggregation: max"}
-				} else {
-					tags = []string{fmt.Sprintf("sandbox: %s", config.SandboxID), "category: asg", "source: aws", "aggregation: sum"}
-				}
+				tags = []string{fmt.Sprintf("sandbox: %s", config.SandboxID), "category: asg", "source: " + infraSource, "aggregation: " + infraAggregation(metricName)}
+				tags = append(tags, infraMetricTags(fmt.Sprintf("%s%d.%s", prefix, i, metricName))...)
 
 				cBundleMetricArr[metricCount] = *c.createMetric(metricFullname, tags)
 				metricCount++
@@ -228,6 +356,16 @@ func (c *CirconusProxy) createMetricsArray() ([]circonusApi.CheckBundleMetric, e
 	}
 	log.Tracef("Node metrics done, %d metrics created so far", metricCount)
 
+	for _, metricName := range otherMetrics {
+		metricFullname := fmt.Sprintf("%s.%s", config.SandboxID, metricName)
+		category := strings.Split(metricName, ".")[0]
+		tags = []string{fmt.Sprintf("sandbox: %s", config.SandboxID), fmt.Sprintf("category: %s", category), "source: tems"}
+
+		cBundleMetricArr = append(cBundleMetricArr, *c.createMetric(metricFullname, tags))
+		metricCount++
+	}
+	log.Tracef("Other metrics done, %d metrics created so far", metricCount)
+
 	return cBundleMetricArr, nil
 }
 
@@ -266,9 +404,13 @@ func (c *CirconusProxy) PushDatapoint(timestamp int64, name string, value string
 	req, _ := http.NewRequest("POST", c.httpAPIURL, strings.NewReader(sb.String()))
 	req.Header.Add("X-Circonus-Auth-Token", config.CirconusAPIToken)
 	req.Header.Add("X-Circonus-App-Name", "tems")
-	_, err := c.httpAPIclient.Do(req)
+	response, err := c.httpAPIclient.Do(req)
 	if err != nil {
 		log.Errorf("error while sending the HTTP POST request:\n\t%s\n\tFor request payload %s\n", err, payload)
+		return
 	}
+	// The body must be read and closed for the connection to be reused
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
 
 }
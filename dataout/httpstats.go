@@ -0,0 +1,42 @@
+package dataout
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/httpclient"
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	httpStatsInterval = 60 * time.Second
+)
+
+// PublishHTTPClientStats pushes the connection reuse stats of the HTTP clients every minute, forever
+// conn.setup.duration is the average DNS + TCP + TLS time of the new connections over the interval
+func PublishHTTPClientStats() {
+	for {
+		time.Sleep(httpStatsInterval)
+		timestamp := time.Now().Unix()
+
+		for _, stats := range httpclient.TakeStats() {
+			pushHTTPStat(timestamp, stats.Name, "requests", strconv.FormatInt(stats.Requests, 10))
+			pushHTTPStat(timestamp, stats.Name, "conn.new", strconv.FormatInt(stats.NewConns, 10))
+			pushHTTPStat(timestamp, stats.Name, "conn.reused", strconv.FormatInt(stats.ReusedConns, 10))
+			if stats.NewConns > 0 {
+				setupMs := float64(stats.SetupDuration.Nanoseconds()) / 1000 / 1000 / float64(stats.NewConns)
+				pushHTTPStat(timestamp, stats.Name, "conn.setup.duration", fmt.Sprintf("%.2f", setupMs))
+			}
+		}
+	}
+}
+
+func pushHTTPStat(timestamp int64, clientName string, metricName string, value string) {
+	select {
+	case ResultChan <- Result{Timestamp: timestamp, Name: fmt.Sprintf("%s.http.%s.%s", config.SandboxID, clientName, metricName), Value: value}:
+	default:
+		log.Error("Channel full, discarding result")
+	}
+}
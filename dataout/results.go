@@ -2,6 +2,9 @@ package dataout
 
 import (
 	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	log "github.com/aleveille/tems/logger"
 )
@@ -9,6 +12,9 @@ import (
 var (
 	// ResultChan is where each data sources will publish the data they gather
 	ResultChan chan Result
+
+	// resultsInFlight is 1 while handleResult() pushes a result, see FlushResults()
+	resultsInFlight int32
 )
 
 // Result is an abstration of a datapoint result to be pushed to Circonus SaaS platform
@@ -21,6 +27,8 @@ type Result struct {
 	// https://login.circonus.com/resources/docs/user/Data/CheckTypes/Resmon.html
 	// Guess: i = int, I = int64, l = uint, L = uint64, n = numeric (float?), s = string
 	Datatype string
+	// Tags are the metadata of the result (eg: the instance type of an infra result), in the result log only
+	Tags []string
 }
 
 // InitResultChan initialize the result channel
@@ -36,6 +44,9 @@ func InitResultChan() error {
 
 // ToString formats the result in a human-readable and machine-parsable string
 func (r *Result) ToString() string {
+	if len(r.Tags) > 0 {
+		return fmt.Sprintf("[%d] %s=%s {%s}", r.Timestamp, r.Name, r.Value, strings.Join(r.Tags, ", "))
+	}
 	return fmt.Sprintf("[%d] %s=%s", r.Timestamp, r.Name, r.Value)
 }
 
@@ -44,6 +55,7 @@ func handleResult() {
 	for {
 		select {
 		case result := <-ResultChan:
+			atomic.StoreInt32(&resultsInFlight, 1)
 			log.PrintToResultLog(result.ToString())
 			dt := result.Datatype
 			if dt == "" {
@@ -58,5 +70,20 @@ func handleResult() {
 			}
 			CirconusProxyInstance.PushDatapoint(result.Timestamp, result.Name, val, dt)
 		}
+		atomic.StoreInt32(&resultsInFlight, 0)
+	}
+}
+
+// FlushResults waits until every result of the channel has been pushed, eg: before exiting after a backfill
+// The channel must be seen idle twice in a row, a result can be received but not flagged in flight yet
+func FlushResults() {
+	idleChecks := 0
+	for idleChecks < 2 {
+		time.Sleep(100 * time.Millisecond)
+		if len(ResultChan) > 0 || atomic.LoadInt32(&resultsInFlight) == 1 {
+			idleChecks = 0
+			continue
+		}
+		idleChecks++
 	}
 }
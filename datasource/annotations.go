@@ -0,0 +1,157 @@
+package datasource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	log "github.com/aleveille/tems/logger"
+)
+
+// Annotations mark on the Grafana dashboards when tems changed behaviour. The kinds are:
+// run (start/stop), phase (eg: a sweep pass), config (a change since the previous run), anomaly (eg: a query starts failing)
+// and scale (an ASG or instance joining or leaving the sandbox)
+
+var (
+	grafanaAnnotationsURL = "%s/api/annotations"
+
+	// Health of every query (true when the last run failed), to annotate the transitions only
+	queryHealthMutex sync.Mutex
+	queryFailing     = map[string]bool{}
+)
+
+// Annotate posts an annotation to Grafana in the background, if config.Annotations is set
+func Annotate(kind string, text string) {
+	if !config.Annotations || GrafanaProxyInstance == nil {
+		return
+	}
+
+	go AnnotateSync(kind, text)
+}
+
+// AnnotateSync posts an annotation to Grafana and waits for it to be saved (eg: before exiting)
+func AnnotateSync(kind string, text string) {
+	if !config.Annotations || GrafanaProxyInstance == nil {
+		return
+	}
+
+	err := GrafanaProxyInstance.postAnnotation(kind, text)
+	if err != nil {
+		log.Errorf("Error while posting the %s annotation to Grafana:\n%v\n", kind, err)
+	}
+}
+
+func (g *GrafanaProxy) postAnnotation(kind string, text string) error {
+	annotation := map[string]interface{}{
+		"time": time.Now().UnixNano() / int64(time.Millisecond),
+		"tags": []string{"tems", "sandbox:" + config.SandboxID, "tsdb:" + config.TSDBSystem, kind},
+		"text": text,
+	}
+	// Without a dashboard, the annotation is organization-wide and shows on every dashboard querying these tags
+	if config.AnnotationsDashboardUID != "" {
+		annotation["dashboardUID"] = config.AnnotationsDashboardUID
+	}
+
+	payload, err := json.Marshal(annotation)
+	if err != nil {
+		return fmt.Errorf("error while encoding the annotation:\n\t%s", err)
+	}
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf(grafanaAnnotationsURL, config.GrafanaURL), bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+
+	_, err = g.doProxiedHTTPRequest(req, "annotations")
+	return err
+}
+
+// AnnotateRunStart annotates the start of the run, and the configuration changes since the previous run
+// The previous configuration is kept in config.AnnotationsStateFile
+func AnnotateRunStart() {
+	current := runConfigSummary()
+	AnnotateSync("run", fmt.Sprintf("tems run started (%s)", formatConfigSummary(current)))
+
+	previous := map[string]string{}
+	content, err := ioutil.ReadFile(config.AnnotationsStateFile)
+	if err == nil {
+		err = json.Unmarshal(content, &previous)
+		if err != nil {
+			log.Warnf("Ignoring the invalid annotations state file %s: %v", config.AnnotationsStateFile, err)
+		}
+	}
+
+	if len(previous) > 0 {
+		changes := []string{}
+		for key, value := range current {
+			if previous[key] != value {
+				changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, previous[key], value))
+			}
+		}
+		sort.Strings(changes)
+
+		if len(changes) > 0 {
+			AnnotateSync("config", "Configuration changed since the previous run: "+strings.Join(changes, ", "))
+		}
+	}
+
+	content, _ = json.Marshal(current)
+	err = ioutil.WriteFile(config.AnnotationsStateFile, content, 0644)
+	if err != nil {
+		log.Warnf("Error while writing the annotations state file %s: %v", config.AnnotationsStateFile, err)
+	}
+}
+
+// runConfigSummary is the configuration that changes the load tems puts on the TSDB
+func runConfigSummary() map[string]string {
+	return map[string]string{
+		"tsdbSystem":                     config.TSDBSystem,
+		"queryMode":                      config.QueryMode,
+		"grafanaQueryAPI":                config.GrafanaQueryAPI,
+		"irondbCaqlUseTags":              fmt.Sprintf("%t", config.CAQLUseTags),
+		"querySweep":                     fmt.Sprintf("%t", config.QuerySweep),
+		"querySweepRanges":               config.QuerySweepRanges,
+		"querySweepSteps":                config.QuerySweepSteps,
+		"histogramScenarios":             fmt.Sprintf("%t", config.HistogramScenarios),
+		"metadataScenarios":              fmt.Sprintf("%t", config.MetadataScenarios),
+		"canary":                         fmt.Sprintf("%t", config.Canary),
+		"tsdbStats":                      fmt.Sprintf("%t", config.TSDBStats),
+		"awsExpectedASGs":                fmt.Sprintf("%d", config.AWSExpectedASGs),
+		"awsExpectedInstanceCountPerASG": fmt.Sprintf("%d", config.AWSExpectedInstanceCountPerASG),
+		"awsASGTags":                     config.AWSASGTags,
+		"infraSource":                    config.InfraSource,
+		"awsCWAgentMetrics":              fmt.Sprintf("%t", config.AWSCWAgentMetrics),
+		"awsEBSVolumeMetrics":            fmt.Sprintf("%t", config.AWSEBSVolumeMetrics),
+		"cloudwatchPeriod":               config.CloudWatchPeriod.String(),
+		"cloudwatchExtendedStats":        config.CloudWatchExtendedStats,
+	}
+}
+
+func formatConfigSummary(summary map[string]string) string {
+	entries := make([]string, 0, len(summary))
+	for key, value := range summary {
+		entries = append(entries, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(entries)
+
+	return strings.Join(entries, ", ")
+}
+
+// trackQueryHealth annotates an anomaly when a query starts failing, and when it recovers
+func trackQueryHealth(queryMetricName string, ok bool) {
+	queryHealthMutex.Lock()
+	wasFailing := queryFailing[queryMetricName]
+	queryFailing[queryMetricName] = !ok
+	queryHealthMutex.Unlock()
+
+	if !ok && !wasFailing {
+		Annotate("anomaly", fmt.Sprintf("Query %s started failing", queryMetricName))
+	} else if ok && wasFailing {
+		Annotate("anomaly", fmt.Sprintf("Query %s recovered", queryMetricName))
+	}
+}
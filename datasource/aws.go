@@ -2,18 +2,23 @@ package datasource
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
 
 	"github.com/aleveille/tems/config"
-	"github.com/aleveille/tems/dataout"
 	appError "github.com/aleveille/tems/error"
+	"github.com/aleveille/tems/httpclient"
 	log "github.com/aleveille/tems/logger"
 )
 
@@ -29,9 +34,9 @@ type AWSProxy struct {
 
 	cloudwatchService  *cloudwatch.CloudWatch
 	autoscalingService *autoscaling.AutoScaling
+	ec2Service         *ec2.EC2
 
-	AsgNames    []string
-	InstanceIDs []string
+	topology *sandboxTopology
 }
 
 type DimensionQuery struct {
@@ -53,8 +58,7 @@ func InitAWSProxy() (*AWSProxy, error) {
 	proxy := AWSProxy{}
 	var err error
 
-	proxy.AsgNames = make([]string, config.AWSExpectedASGs)
-	proxy.InstanceIDs = make([]string, config.AWSExpectedASGs*config.AWSExpectedInstanceCountPerASG)
+	proxy.topology = newSandboxTopology(config.AWSExpectedASGs, config.AWSExpectedInstanceCountPerASG)
 
 	err = proxy.openSession()
 	if err != nil {
@@ -73,9 +77,9 @@ func InitAWSProxy() (*AWSProxy, error) {
 		return &proxy, err
 	}
 
-	err = proxy.findSandboxIRONdbAutoscalingGroups()
+	err = proxy.RefreshTopology()
 	if err != nil {
-		return &proxy, err
+		return &proxy, appError.NewInitializationError("couldn't discover the sandbox ASGs", err)
 	}
 
 	AWSProxyInstance = proxy
@@ -92,6 +96,12 @@ func (a *AWSProxy) openSession() error {
 		Config: aws.Config{
 			Region:                        aws.String(config.AWSRegion),
 			CredentialsChainVerboseErrors: &btrue,
+			// Every service client, STS included, shares the tracked client (TLS, outbound proxy and stats)
+			HTTPClient: httpclient.New(httpclient.AWSClient, httpclient.Settings{
+				Timeout:             config.HTTPAWSTimeout,
+				DialTimeout:         1000 * time.Millisecond,
+				TLSHandshakeTimeout: 2000 * time.Millisecond,
+			}),
 		},
 	})
 	a.awsSession = awsSession
@@ -100,9 +110,43 @@ func (a *AWSProxy) openSession() error {
 		return appError.NewInitializationError("couldn't open session with AWS", err)
 	}
 
+	// The roles are assumed with the default credentials (the profile, the instance role, etc)
+	switch config.AWSCredentials {
+	case "env":
+		a.awsSession = awsSession.Copy(&aws.Config{Credentials: credentials.NewEnvCredentials()})
+	case "assume-role":
+		stsService := sts.New(awsSession, serviceConfig("sts"))
+		a.awsSession = awsSession.Copy(&aws.Config{Credentials: stscreds.NewCredentialsWithClient(stsService, config.AWSRoleARN, func(provider *stscreds.AssumeRoleProvider) {
+			provider.RoleSessionName = config.AWSRoleSessionName
+			if config.AWSRoleExternalID != "" {
+				provider.ExternalID = aws.String(config.AWSRoleExternalID)
+			}
+		})})
+	case "web-identity":
+		stsService := sts.New(awsSession, serviceConfig("sts"))
+		a.awsSession = awsSession.Copy(&aws.Config{Credentials: credentials.NewCredentials(
+			stscreds.NewWebIdentityRoleProvider(stsService, config.AWSRoleARN, config.AWSRoleSessionName, config.AWSWebIdentityTokenFile),
+		)})
+	}
+
 	return nil
 }
 
+// serviceConfig returns the configuration of an AWS service client, with its endpoint when it is overridden
+// (eg: a local stand-in of the AWS APIs)
+func serviceConfig(service string) *aws.Config {
+	endpoint, ok := config.AWSEndpointMap[service]
+	if !ok {
+		endpoint = config.AWSEndpointURL
+	}
+	if endpoint == "" {
+		return &aws.Config{}
+	}
+
+	log.Debugf("AWS: Using the endpoint %s for %s", endpoint, service)
+	return &aws.Config{Endpoint: aws.String(endpoint)}
+}
+
 func (a *AWSProxy) validateSession() error {
 	log.Trace("AWS validateSession() start")
 	defer log.Trace("AWS validateSession() end")
@@ -116,19 +160,30 @@ func (a *AWSProxy) validateSession() error {
 }
 
 func (a *AWSProxy) createServices() error {
-	a.cloudwatchService = cloudwatch.New(a.awsSession)
-	a.autoscalingService = autoscaling.New(a.awsSession)
+	a.cloudwatchService = cloudwatch.New(a.awsSession, serviceConfig("cloudwatch"))
+	a.autoscalingService = autoscaling.New(a.awsSession, serviceConfig("autoscaling"))
+	a.ec2Service = ec2.New(a.awsSession, serviceConfig("ec2"))
 
 	return nil
 }
 
-func (a *AWSProxy) findSandboxIRONdbAutoscalingGroups() error {
-	log.Trace("AWS findSandboxIRONdbAutoscalingGroups() start")
-	defer log.Trace("AWS findSandboxIRONdbAutoscalingGroups() end")
+// findSandboxAutoscalingGroups returns the ASGs of the sandbox, sorted by name. They are matched by tags
+// when config.AWSASGTags is set, by name otherwise
+func (a *AWSProxy) findSandboxAutoscalingGroups() ([]*autoscaling.Group, error) {
+	log.Trace("AWS findSandboxAutoscalingGroups() start")
+	defer log.Trace("AWS findSandboxAutoscalingGroups() end")
 
 	sandboxASGPrefix := fmt.Sprintf("%s_%s-nodes", config.SandboxID, config.TSDBSystem)
 
-	foundAsgCount := 0
+	filters := []*autoscaling.Filter{}
+	for key, value := range config.AWSASGTagFilters {
+		filters = append(filters, &autoscaling.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []*string{aws.String(value)},
+		})
+	}
+
+	groups := []*autoscaling.Group{}
 	var nextToken *string
 
 	// Prevents looping forever with a safe limit
@@ -136,124 +191,116 @@ func (a *AWSProxy) findSandboxIRONdbAutoscalingGroups() error {
 		input := &autoscaling.DescribeAutoScalingGroupsInput{
 			NextToken: nextToken,
 		}
+		if len(filters) > 0 {
+			input.Filters = filters
+		}
 
 		result, err := a.autoscalingService.DescribeAutoScalingGroups(input)
 
 		if err != nil {
 			if aerr, ok := err.(awserr.Error); ok {
-				switch aerr.Code() {
-				case autoscaling.ErrCodeInvalidNextToken:
-					return appError.NewInitializationError(fmt.Sprintf("usage error while looking up IRONdb autoscaling groups: %s", autoscaling.ErrCodeInvalidNextToken), aerr)
-				case autoscaling.ErrCodeResourceContentionFault:
-					return appError.NewInitializationError(fmt.Sprintf("usage error while looking up IRONdb autoscaling groups: %s", autoscaling.ErrCodeResourceContentionFault), aerr)
-				default:
-					return appError.NewInitializationError(fmt.Sprintf("error while looking up IRONdb autoscaling groups: %s", aerr.Code), aerr)
-				}
+				return nil, fmt.Errorf("error while looking up the sandbox autoscaling groups: %s: %s", aerr.Code(), aerr.Message())
 			}
 
-			return appError.NewInitializationError("unknown error while looking up IRONdb autoscaling groups", err)
+			return nil, fmt.Errorf("unknown error while looking up the sandbox autoscaling groups: %s", err)
 		}
 
 		for _, group := range result.AutoScalingGroups {
-			if strings.Contains(*group.AutoScalingGroupName, sandboxASGPrefix) {
-				a.AsgNames[foundAsgCount] = *group.AutoScalingGroupName
-
-				for index, inst := range (*group).Instances {
-					if index < config.AWSExpectedInstanceCountPerASG {
-						instanceNb := foundAsgCount*config.AWSExpectedInstanceCountPerASG + index
-						a.InstanceIDs[instanceNb] = *inst.InstanceId
-					} else {
-						log.Errorf("found too many instances in ASG %s*\n", *group.AutoScalingGroupName)
-					}
-				}
-
-				foundAsgCount++
-
-				// Break as soon as we've found the expected number of ASG
-				if foundAsgCount >= config.AWSExpectedASGs {
-					result.NextToken = nil
-					break
-				}
+			if len(filters) > 0 || strings.Contains(aws.StringValue(group.AutoScalingGroupName), sandboxASGPrefix) {
+				groups = append(groups, group)
 			}
 		}
 
-		if result.NextToken == nil { // No more pages and/or all expected ASG found
+		if result.NextToken == nil { // No more pages
 			break
 		} else {
 			nextToken = result.NextToken
 		}
 	}
 
-	log.Debugf("asgNames: %s\n", a.AsgNames)
-	log.Debugf("instanceIDs: %s\n", a.InstanceIDs)
+	sort.Slice(groups, func(i, j int) bool {
+		return aws.StringValue(groups[i].AutoScalingGroupName) < aws.StringValue(groups[j].AutoScalingGroupName)
+	})
+
+	return groups, nil
+}
+
+// describeInstances returns the metadata of the instances, their EBS volumes by device name order included
+// Only the IDs of the volumes are set, see findVolumes()
+func (a *AWSProxy) describeInstances(instanceIDs []string) (map[string]*instanceMetadata, error) {
+	log.Trace("AWS describeInstances() start")
+	defer log.Trace("AWS describeInstances() end")
 
-	if len(a.AsgNames) == 0 {
-		log.Warn("No ASG found for the sandbox")
+	instances := map[string]*instanceMetadata{}
+	if len(instanceIDs) == 0 {
+		return instances, nil
 	}
-	if len(a.InstanceIDs) == 0 {
-		log.Warn("No instances found for the sandbox")
+
+	err := a.ec2Service.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice(instanceIDs),
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, instance := range reservation.Instances {
+				mappings := []*ec2.InstanceBlockDeviceMapping{}
+				for _, mapping := range instance.BlockDeviceMappings {
+					if mapping.Ebs != nil && mapping.Ebs.VolumeId != nil {
+						mappings = append(mappings, mapping)
+					}
+				}
+				sort.Slice(mappings, func(i, j int) bool {
+					return aws.StringValue(mappings[i].DeviceName) < aws.StringValue(mappings[j].DeviceName)
+				})
+
+				metadata := &instanceMetadata{
+					InstanceType: aws.StringValue(instance.InstanceType),
+					LaunchTime:   aws.TimeValue(instance.LaunchTime),
+					Volumes:      []volumeMetadata{},
+				}
+				if instance.Placement != nil {
+					metadata.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+				}
+				for _, mapping := range mappings {
+					metadata.Volumes = append(metadata.Volumes, volumeMetadata{VolumeID: aws.StringValue(mapping.Ebs.VolumeId)})
+				}
+				instances[aws.StringValue(instance.InstanceId)] = metadata
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while describing the instances: %s", err)
 	}
 
-	return nil
+	return instances, nil
 }
 
-// GrabAWSmetric will query the AWS API to grab a CloudWatch metric
-func (a *AWSProxy) GrabAWSmetric(resultMetricName string, awsMetricName string, namespace string, dimensionName string, dimensionValue string, stat string) {
-	queryTimestamp := time.Now()
-
-	startTime := queryTimestamp.Add(-61 * time.Second)
-	endTime := queryTimestamp
-
-	metricDataQuery := []*cloudwatch.MetricDataQuery{
-		&cloudwatch.MetricDataQuery{
-			Id: aws.String("queryid"),
-			MetricStat: &cloudwatch.MetricStat{
-				Metric: &cloudwatch.Metric{
-					MetricName: aws.String(awsMetricName),
-					Namespace:  aws.String(namespace),
-					Dimensions: []*cloudwatch.Dimension{
-						&cloudwatch.Dimension{
-							Name:  aws.String(dimensionName),
-							Value: aws.String(dimensionValue),
-						},
-					},
-				},
-				Period: aws.Int64(60),
-				Stat:   aws.String(stat),
-			},
-		},
-	}
+// findVolumes returns the type, size and provisioned performance of each EBS volume
+func (a *AWSProxy) findVolumes(volumeIDs []string) (map[string]volumeMetadata, error) {
+	log.Trace("AWS findVolumes() start")
+	defer log.Trace("AWS findVolumes() end")
 
-	out, getErr := a.cloudwatchService.GetMetricData(&cloudwatch.GetMetricDataInput{
-		StartTime:         &startTime,
-		EndTime:           &endTime,
-		MetricDataQueries: metricDataQuery,
-	})
+	volumes := map[string]volumeMetadata{}
+	if len(volumeIDs) == 0 {
+		return volumes, nil
+	}
 
-	metricTimestamp := int64(0)
-	val := "nan"
-	if getErr != nil {
-		log.Errorf("Error while retrieving metric(s):\n%s\n", getErr)
-	} else {
-		if out.MetricDataResults != nil && len(out.MetricDataResults) > 0 {
-			metricDataResult := *(out.MetricDataResults[0])
-			if len(metricDataResult.Values) > 0 {
-				val = fmt.Sprintf("%.2f", *metricDataResult.Values[0])
-				metricTimestamp = (metricDataResult.Timestamps[0]).Unix()
-
-				r := dataout.Result{Timestamp: metricTimestamp, Name: resultMetricName, Value: val}
-				select {
-				case dataout.ResultChan <- r:
-				default:
-					log.Error("Channel full, discarding result")
-				}
-			} else {
-				if awsMetricName != "DiskReadBytes" && awsMetricName != "DiskWriteBytes" && awsMetricName != "EBSReadBytes" && awsMetricName != "EBSkWriteBytes" {
-					log.Warnf("No data values retrieved from AWS for %s / %s • %s=%s: %s", namespace, awsMetricName, dimensionName, dimensionValue, stat)
-				}
+	err := a.ec2Service.DescribeVolumesPages(&ec2.DescribeVolumesInput{
+		VolumeIds: aws.StringSlice(volumeIDs),
+	}, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+		for _, volume := range page.Volumes {
+			volumes[aws.StringValue(volume.VolumeId)] = volumeMetadata{
+				VolumeID:       aws.StringValue(volume.VolumeId),
+				VolumeType:     aws.StringValue(volume.VolumeType),
+				SizeGiB:        aws.Int64Value(volume.Size),
+				Iops:           aws.Int64Value(volume.Iops),
+				ThroughputMBps: aws.Int64Value(volume.Throughput),
 			}
-		} else {
-			log.Warnf("No data results retrieved from AWS for %s / %s • %s=%s: %s", namespace, awsMetricName, dimensionName, dimensionValue, stat)
 		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while describing the EBS volumes: %s", err)
 	}
+
+	return volumes, nil
 }
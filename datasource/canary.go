@@ -0,0 +1,91 @@
+package datasource
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/dataout"
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	// CanaryMetrics are the metric names (relative to the sandbox ID) reported by the canary
+	CanaryMetrics = []string{"canary.write.duration", "canary.visibility.duration"}
+
+	canaryMetricName = "tems-canary"
+
+	// Read queries used to poll the canary value through Grafana, over the last 5 minutes
+	caqlCanaryQuery      = "find(%22tems-canary%22)"
+	influxdbCanaryQuery  = `SELECT last("value") FROM "tems-canary" WHERE time >= now() - %s`
+	timescaleCanaryQuery = `SELECT \"time\", value FROM tems_canary WHERE $__timeFilter(\"time\") ORDER BY 1`
+)
+
+// VisibilityCanary will write a uniquely-valued point through the TSDB native write API and then poll Grafana
+// until the point is readable. It reports the write duration and the write-to-read visibility latency.
+func VisibilityCanary() {
+	writeTime := time.Now()
+	// The write time in ms is unique and always increasing, which is what we need to recognize our point
+	value := strconv.FormatInt(writeTime.UnixNano()/int64(time.Millisecond), 10)
+
+	err := TSDBProxyInstance.WritePoint(canaryMetricName, value, writeTime)
+	if err != nil {
+		log.Errorf("Canary: error while writing the canary point:\n%v\n", err)
+		return
+	}
+	pushCanaryResult(writeTime.Unix(), "canary.write.duration", time.Since(writeTime))
+
+	for time.Since(writeTime) < config.CanaryTimeout {
+		readValue, err := readCanaryValue()
+		if err != nil {
+			log.Debugf("Canary: error while reading the canary point: %v", err)
+		} else if canaryValueMatches(readValue, value) {
+			pushCanaryResult(writeTime.Unix(), "canary.visibility.duration", time.Since(writeTime))
+			return
+		}
+
+		time.Sleep(config.CanaryPollInterval)
+	}
+
+	log.Warnf("Canary: point %s wasn't readable through Grafana after %s", value, config.CanaryTimeout)
+	Annotate("anomaly", fmt.Sprintf("Canary point written at %s wasn't readable after %s", writeTime.UTC().Format(time.RFC3339), config.CanaryTimeout))
+}
+
+func readCanaryValue() (string, error) {
+	now := time.Now().Unix()
+	switch config.TSDBSystem {
+	case "irondb":
+		return GrafanaProxyInstance.doProxiedCAQLHTTPQuery(caqlCanaryQuery, now-300, now, defaultCAQLPeriod)
+	case "influxdb":
+		return GrafanaProxyInstance.doProxiedInfluxDBHTTPQuery(config.InfluxDBDatabaseName, fmt.Sprintf(influxdbCanaryQuery, "5m"), config.InfluxDBEpoch)
+	case "timescale":
+		return GrafanaProxyInstance.doProxiedTimescaleDBHTTPQuery(timescaleCanaryQuery, (now-300)*1000, now*1000, defaultIntervalMs, defaultMaxDataPoints)
+	default:
+		return "nan", fmt.Errorf("the canary doesn't support %s", config.TSDBSystem)
+	}
+}
+
+// canaryValueMatches compares numerically since the TSDBs may return the value in scientific notation (eg: 1.5e+12)
+func canaryValueMatches(readValue string, expectedValue string) bool {
+	read, err := strconv.ParseFloat(readValue, 64)
+	if err != nil {
+		return false
+	}
+	expected, err := strconv.ParseFloat(expectedValue, 64)
+	if err != nil {
+		return false
+	}
+
+	return read == expected
+}
+
+func pushCanaryResult(timestamp int64, metricName string, duration time.Duration) {
+	durationMs := fmt.Sprintf("%.2f", float64(duration.Nanoseconds())/1000/1000)
+
+	select {
+	case dataout.ResultChan <- dataout.Result{Timestamp: timestamp, Name: fmt.Sprintf("%s.%s", config.SandboxID, metricName), Value: durationMs}:
+	default:
+		log.Error("Channel full, discarding result")
+	}
+}
@@ -0,0 +1,214 @@
+package datasource
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/dataout"
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	// GetMetricData accepts at most 500 queries per call, and CloudWatch limits how many SEARCH expressions a call can run
+	cloudwatchMaxQueriesPerCall  = 500
+	cloudwatchMaxSearchesPerCall = 5
+
+	// Metrics that only have datapoints on some instance or volume types, or with the CloudWatch agent installed,
+	// so a missing value isn't worth a warning
+	cloudwatchSparseMetrics = map[string]bool{
+		"DiskReadBytes": true, "DiskWriteBytes": true, "EBSReadBytes": true, "EBSWriteBytes": true,
+		"BurstBalance": true, "mem_used_percent": true, "disk_used_percent": true,
+	}
+)
+
+// CloudWatchQuery is a CloudWatch metric to collect and the result name it is reported under
+// When Expression is set (eg: a SEARCH), it is run instead of the namespace/metric/dimension/stat, which are only
+// used in the logs. The value is multiplied by Scale when it isn't 0 (eg: 1/60 to turn a 1-minute sum into a rate per second)
+// The results are tagged with Tags
+type CloudWatchQuery struct {
+	ResultName     string
+	Namespace      string
+	MetricName     string
+	DimensionName  string
+	DimensionValue string
+	Stat           string
+	Expression     string
+	Scale          float64
+	Tags           []string
+}
+
+// cloudwatchCollection is the time range of a GetMetricData collection and how its datapoints are pushed
+type cloudwatchCollection struct {
+	startTime time.Time
+	endTime   time.Time
+
+	// allDatapoints pushes every datapoint of the range, not only the latest one
+	allDatapoints bool
+
+	// wait blocks while the result channel is full instead of discarding the results
+	wait bool
+}
+
+// CollectCloudWatchMetrics will push the latest datapoint of every query to the result channel, or all the datapoints
+// of the lag window (config.CloudWatchLagWindow) so the late ones are picked up on the next collections
+// The queries are packed by batches of 500 (or 5 SEARCH expressions) in GetMetricData calls, each one paginated
+func (a *AWSProxy) CollectCloudWatchMetrics(queries []CloudWatchQuery) {
+	endTime := time.Now()
+	a.collectCloudWatch(queries, cloudwatchCollection{
+		startTime:     endTime.Add(-config.CloudWatchPeriod - time.Second - config.CloudWatchLagWindow),
+		endTime:       endTime,
+		allDatapoints: config.CloudWatchLagWindow > 0,
+	})
+}
+
+// BackfillCloudWatchMetrics will push every datapoint of the queries between from and to to the result channel
+func (a *AWSProxy) BackfillCloudWatchMetrics(queries []CloudWatchQuery, from time.Time, to time.Time) {
+	retention := cloudwatchRetention(config.CloudWatchPeriod)
+	if time.Since(from) > retention {
+		log.Warnf("CloudWatch only keeps the %s datapoints for %s, the beginning of the backfill will be missing", config.CloudWatchPeriod, retention)
+	}
+
+	a.collectCloudWatch(queries, cloudwatchCollection{
+		startTime:     from,
+		endTime:       to,
+		allDatapoints: true,
+		wait:          true,
+	})
+}
+
+// cloudwatchRetention is how long CloudWatch keeps the datapoints of a period
+func cloudwatchRetention(period time.Duration) time.Duration {
+	switch {
+	case period < time.Minute:
+		return 3 * time.Hour
+	case period < 5*time.Minute:
+		return 15 * 24 * time.Hour
+	case period < time.Hour:
+		return 63 * 24 * time.Hour
+	default:
+		return 455 * 24 * time.Hour
+	}
+}
+
+func (a *AWSProxy) collectCloudWatch(queries []CloudWatchQuery, collection cloudwatchCollection) {
+	batch := []CloudWatchQuery{}
+	searches := 0
+	for _, query := range queries {
+		isSearch := strings.Contains(query.Expression, "SEARCH(")
+		if len(batch) == cloudwatchMaxQueriesPerCall || (isSearch && searches == cloudwatchMaxSearchesPerCall) {
+			a.collectCloudWatchBatch(batch, collection)
+			batch = []CloudWatchQuery{}
+			searches = 0
+		}
+
+		batch = append(batch, query)
+		if isSearch {
+			searches++
+		}
+	}
+
+	if len(batch) > 0 {
+		a.collectCloudWatchBatch(batch, collection)
+	}
+}
+
+func (a *AWSProxy) collectCloudWatchBatch(queries []CloudWatchQuery, collection cloudwatchCollection) {
+	// The ids only need to be unique within the call, they map the results back to the queries
+	queriesByID := map[string]CloudWatchQuery{}
+	metricDataQueries := make([]*cloudwatch.MetricDataQuery, len(queries))
+	for index, query := range queries {
+		id := fmt.Sprintf("m%d", index)
+		queriesByID[id] = query
+
+		if query.Expression != "" {
+			metricDataQueries[index] = &cloudwatch.MetricDataQuery{
+				Id:         aws.String(id),
+				Expression: aws.String(query.Expression),
+			}
+			continue
+		}
+
+		metricDataQueries[index] = &cloudwatch.MetricDataQuery{
+			Id: aws.String(id),
+			MetricStat: &cloudwatch.MetricStat{
+				Metric: &cloudwatch.Metric{
+					MetricName: aws.String(query.MetricName),
+					Namespace:  aws.String(query.Namespace),
+					Dimensions: []*cloudwatch.Dimension{
+						{
+							Name:  aws.String(query.DimensionName),
+							Value: aws.String(query.DimensionValue),
+						},
+					},
+				},
+				Period: aws.Int64(int64(config.CloudWatchPeriod / time.Second)),
+				Stat:   aws.String(query.Stat),
+			},
+		}
+	}
+
+	// A result can be split across pages. The datapoints come newest first, so the first one seen for an id is the latest
+	results := map[string][]dataout.Result{}
+	err := a.cloudwatchService.GetMetricDataPages(&cloudwatch.GetMetricDataInput{
+		StartTime:         &collection.startTime,
+		EndTime:           &collection.endTime,
+		MetricDataQueries: metricDataQueries,
+	}, func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+		for _, metricDataResult := range page.MetricDataResults {
+			query, ok := queriesByID[aws.StringValue(metricDataResult.Id)]
+			if !ok {
+				continue
+			}
+
+			for index := range metricDataResult.Values {
+				if !collection.allDatapoints && len(results[query.ResultName]) > 0 {
+					break
+				}
+
+				value := *metricDataResult.Values[index]
+				if query.Scale != 0 {
+					value *= query.Scale
+				}
+				results[query.ResultName] = append(results[query.ResultName], dataout.Result{
+					Timestamp: metricDataResult.Timestamps[index].Unix(),
+					Name:      query.ResultName,
+					Value:     fmt.Sprintf("%.2f", value),
+					Tags:      query.Tags,
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Errorf("Error while retrieving metric(s):\n%s\n", err)
+		return
+	}
+
+	for _, query := range queries {
+		queryResults, ok := results[query.ResultName]
+		if !ok {
+			if !cloudwatchSparseMetrics[query.MetricName] {
+				log.Warnf("No data values retrieved from AWS for %s / %s • %s=%s: %s", query.Namespace, query.MetricName, query.DimensionName, query.DimensionValue, query.Stat)
+			}
+			continue
+		}
+
+		for _, result := range queryResults {
+			if collection.wait {
+				dataout.ResultChan <- result
+				continue
+			}
+
+			select {
+			case dataout.ResultChan <- result:
+			default:
+				log.Error("Channel full, discarding result")
+			}
+		}
+	}
+}
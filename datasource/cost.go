@@ -0,0 +1,133 @@
+package datasource
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/dataout"
+	log "github.com/aleveille/tems/logger"
+)
+
+// The cost model prices the instances and EBS volumes of the sandbox with the price table, and relates the cost of
+// the run to its workload: the datapoints ingested (config.CostIngestRate) and the queries run by tems
+
+var (
+	costInterval = time.Minute
+
+	// queriesRun is the number of queries timed since the previous cost interval, see timeQuery()
+	queriesRun int64
+)
+
+// CostMetrics returns the metric names (relative to the sandbox ID) reported by the cost model
+// The cost per million datapoints needs the ingest rate, which tems doesn't measure
+func CostMetrics() []string {
+	metrics := []string{"cost.cluster.hourly", "cost.run.total", "cost.per.thousand.queries"}
+	if config.CostIngestRate > 0 {
+		metrics = append(metrics, "cost.per.million.datapoints")
+	}
+
+	return metrics
+}
+
+// PublishCostMetrics pushes the cost of the sandbox every minute, forever
+// The cost of the run only adds up the minutes where every instance and volume type had a price, and is related to
+// the datapoints and queries of these minutes only
+func PublishCostMetrics() {
+	runCost := 0.0
+	pricedSeconds := 0.0
+	pricedQueries := int64(0)
+	warned := map[string]bool{}
+
+	lastTime := time.Now()
+	for {
+		time.Sleep(costInterval)
+		now := time.Now()
+		elapsed := now.Sub(lastTime)
+		lastTime = now
+		queries := atomic.SwapInt64(&queriesRun, 0)
+
+		hourly, missing := AWSProxyInstance.hourlyCost()
+		if len(missing) > 0 {
+			for _, name := range missing {
+				if !warned[name] {
+					log.Warnf("No price for %s, the cost of the sandbox isn't reported (see priceTableFile)", name)
+					warned[name] = true
+				}
+			}
+			continue
+		}
+
+		runCost += hourly * elapsed.Hours()
+		pricedSeconds += elapsed.Seconds()
+		pricedQueries += queries
+
+		pushCostResult(now, "cluster.hourly", hourly)
+		pushCostResult(now, "run.total", runCost)
+		if config.CostIngestRate > 0 {
+			pushCostResult(now, "per.million.datapoints", runCost/(config.CostIngestRate*pricedSeconds/1e6))
+		}
+		if pricedQueries > 0 {
+			pushCostResult(now, "per.thousand.queries", runCost/(float64(pricedQueries)/1000))
+		}
+	}
+}
+
+// hourlyCost returns the hourly price of the instances and EBS volumes of the slots, and the instance and volume
+// types without a price (the cost is then incomplete)
+func (a *AWSProxy) hourlyCost() (float64, []string) {
+	a.topology.mutex.RLock()
+	defer a.topology.mutex.RUnlock()
+
+	hourly := 0.0
+	missing := map[string]bool{}
+	for _, instanceID := range a.topology.instanceIDs {
+		if instanceID == "" {
+			continue
+		}
+
+		metadata, ok := a.topology.instances[instanceID]
+		if !ok {
+			missing["instance "+instanceID] = true
+			continue
+		}
+
+		price, ok := prices.Instances[metadata.InstanceType]
+		if !ok {
+			missing["instance type "+metadata.InstanceType] = true
+		}
+		hourly += price
+
+		for _, volume := range metadata.Volumes {
+			if volume.VolumeType == "" {
+				missing["volume "+volume.VolumeID] = true
+				continue
+			}
+			volumePrice, ok := prices.Volumes[volume.VolumeType]
+			if !ok {
+				missing["volume type "+volume.VolumeType] = true
+				continue
+			}
+			hourly += volumePrice.hourlyPrice(volume)
+		}
+	}
+
+	missingNames := make([]string, 0, len(missing))
+	for name := range missing {
+		missingNames = append(missingNames, name)
+	}
+	sort.Strings(missingNames)
+
+	return hourly, missingNames
+}
+
+func pushCostResult(timestamp time.Time, metricName string, value float64) {
+	r := dataout.Result{Timestamp: timestamp.Unix(), Name: fmt.Sprintf("%s.cost.%s", config.SandboxID, metricName), Value: fmt.Sprintf("%.4f", value)}
+	select {
+	case dataout.ResultChan <- r:
+	default:
+		log.Error("Channel full, discarding result")
+	}
+}
@@ -0,0 +1,102 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/aleveille/tems/config"
+	appError "github.com/aleveille/tems/error"
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	// Grafana datasource plugin types accepted for each TSDB system
+	tsdbDatasourceTypes = map[string][]string{
+		"irondb":    {"circonus-irondb-datasource"},
+		"influxdb":  {"influxdb"},
+		"timescale": {"postgres", "grafana-postgresql-datasource"},
+	}
+
+	// The beta Flux plugin, or the regular InfluxDB plugin with the Flux query language
+	fluxDatasourceTypes = []string{"grafana-influxdb-flux-datasource", "influxdb"}
+)
+
+// grafanaDatasource is the subset of a /api/datasources entry we need
+type grafanaDatasource struct {
+	ID   int    `json:"id"`
+	UID  string `json:"uid"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// discoverDatasources resolves the datasources to query through the Grafana API, since every Grafana numbers them differently
+func (g *GrafanaProxy) discoverDatasources() error {
+	log.Trace("Grafana discoverDatasources() start")
+	defer log.Trace("Grafana discoverDatasources() end")
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/datasources", config.GrafanaURL), nil)
+	body, err := g.doProxiedHTTPRequest(req, "datasources")
+	if err != nil {
+		return appError.NewInitializationError("Error while listing the Grafana datasources", err)
+	}
+
+	var datasources []grafanaDatasource
+	if err := json.Unmarshal(body, &datasources); err != nil {
+		return appError.NewInitializationError("Unexpected Grafana datasources response body", err)
+	}
+
+	queryDatasource, err := findDatasource(datasources, config.GrafanaDatasource, tsdbDatasourceTypes[config.TSDBSystem])
+	if err != nil {
+		return err
+	}
+	g.queryDatasource = *queryDatasource
+	log.Infof("Grafana: Using datasource %q (id %d, type %s)", queryDatasource.Name, queryDatasource.ID, queryDatasource.Type)
+
+	if config.GrafanaFluxDatasource != "" {
+		g.fluxDatasource, err = findDatasource(datasources, config.GrafanaFluxDatasource, fluxDatasourceTypes)
+		if err != nil {
+			return err
+		}
+		log.Infof("Grafana: Using Flux datasource %q (id %d, type %s)", g.fluxDatasource.Name, g.fluxDatasource.ID, g.fluxDatasource.Type)
+	}
+
+	return nil
+}
+
+// findDatasource returns the datasource with the given name or UID, or the first one of an expected type if nameOrUID is empty
+// The datasource type must be one of the expected types
+func findDatasource(datasources []grafanaDatasource, nameOrUID string, expectedTypes []string) (*grafanaDatasource, error) {
+	for i := range datasources {
+		datasource := &datasources[i]
+
+		if nameOrUID == "" {
+			if isExpectedDatasourceType(datasource.Type, expectedTypes) {
+				return datasource, nil
+			}
+			continue
+		}
+
+		if datasource.Name == nameOrUID || datasource.UID == nameOrUID {
+			if !isExpectedDatasourceType(datasource.Type, expectedTypes) {
+				return nil, appError.NewInitializationError(fmt.Sprintf("The Grafana datasource %q is of type %s, expected one of %v", nameOrUID, datasource.Type, expectedTypes), nil)
+			}
+			return datasource, nil
+		}
+	}
+
+	if nameOrUID == "" {
+		return nil, appError.NewInitializationError(fmt.Sprintf("No Grafana datasource of type %v found", expectedTypes), nil)
+	}
+	return nil, appError.NewInitializationError(fmt.Sprintf("No Grafana datasource named %q (or with that UID) found", nameOrUID), nil)
+}
+
+func isExpectedDatasourceType(datasourceType string, expectedTypes []string) bool {
+	for _, expectedType := range expectedTypes {
+		if datasourceType == expectedType {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,168 @@
+package datasource
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aleveille/tems/config"
+)
+
+// The unified query endpoint of current Grafana releases (config.GrafanaQueryAPI = ds). Every backend datasource
+// answers with data frames. The IRONdb find API has no equivalent and keeps going through the datasource proxy.
+
+var (
+	dsQueryURL = "%s/api/ds/query"
+
+	// Range used for the queries that carry their own range (InfluxQL, Flux), Grafana only uses it for its macros
+	dsQueryDefaultRange = int64(3600)
+)
+
+// dsQuery is a single query of a /api/ds/query request. The datasource-specific fields (rawSql, query, etc) go in model
+type dsQuery struct {
+	datasource    grafanaDatasource
+	intervalMs    int64
+	maxDataPoints int64
+	model         map[string]interface{}
+}
+
+// dataFrame is the subset of a Grafana data frame (JSON encoding) we need
+// Values are stored column-wise, one slice per field
+type dataFrame struct {
+	Schema struct {
+		Name   string `json:"name"`
+		Fields []struct {
+			Name   string            `json:"name"`
+			Type   string            `json:"type"`
+			Labels map[string]string `json:"labels"`
+		} `json:"fields"`
+	} `json:"schema"`
+	Data struct {
+		Values [][]interface{} `json:"values"`
+	} `json:"data"`
+}
+
+func (g *GrafanaProxy) doDSQueryHTTPRequest(query dsQuery, startTimestamp int64, endTimestamp int64) ([]dataFrame, error) {
+	model := map[string]interface{}{
+		"refId":         "A",
+		"datasource":    map[string]string{"uid": query.datasource.UID, "type": query.datasource.Type},
+		"datasourceId":  query.datasource.ID,
+		"intervalMs":    query.intervalMs,
+		"maxDataPoints": query.maxDataPoints,
+	}
+	for key, value := range query.model {
+		model[key] = value
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"from":    strconv.FormatInt(startTimestamp, 10),
+		"to":      strconv.FormatInt(endTimestamp, 10),
+		"queries": []interface{}{model},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error while encoding the /api/ds/query request:\n\t%s", err)
+	}
+
+	req, _ := http.NewRequest("POST", fmt.Sprintf(dsQueryURL, config.GrafanaURL), bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	body, err := g.doProxiedHTTPRequest(req, "ds/query")
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Results map[string]struct {
+			Error  string      `json:"error"`
+			Frames []dataFrame `json:"frames"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("unexpected /api/ds/query response body: %s", err)
+	}
+
+	result, ok := response.Results["A"]
+	if !ok {
+		return nil, fmt.Errorf("no result in the /api/ds/query response")
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("/api/ds/query error: %s", result.Error)
+	}
+
+	return result.Frames, nil
+}
+
+// doDSQuery returns the last value of the first series, like the legacy paths do
+func (g *GrafanaProxy) doDSQuery(query dsQuery, startTimestamp int64, endTimestamp int64) (string, error) {
+	frames, err := g.doDSQueryHTTPRequest(query, startTimestamp, endTimestamp)
+	if err != nil {
+		return "nan", err
+	}
+
+	return lastSeriesValue(decodeDataFrames(frames)), nil
+}
+
+// doDSMetadataQuery returns the number of rows across all frames
+func (g *GrafanaProxy) doDSMetadataQuery(query dsQuery, startTimestamp int64, endTimestamp int64) (string, error) {
+	frames, err := g.doDSQueryHTTPRequest(query, startTimestamp, endTimestamp)
+	if err != nil {
+		return "nan", err
+	}
+
+	count := 0
+	for _, frame := range frames {
+		if len(frame.Data.Values) > 0 {
+			count += len(frame.Data.Values[0])
+		}
+	}
+
+	return strconv.Itoa(count), nil
+}
+
+func (g *GrafanaProxy) caqlDSQuery(queryString string, period int64) (dsQuery, error) {
+	// The CAQL queries are written URL-encoded for the proxy path
+	caql, err := url.QueryUnescape(queryString)
+	if err != nil {
+		return dsQuery{}, fmt.Errorf("invalid CAQL query encoding: %s", err)
+	}
+
+	return dsQuery{
+		datasource:    g.queryDatasource,
+		intervalMs:    period * 1000,
+		maxDataPoints: defaultMaxDataPoints,
+		model:         map[string]interface{}{"querytype": "caql", "query": caql},
+	}, nil
+}
+
+// influxQLDSQuery queries the database of the Grafana datasource, /api/ds/query has no db parameter (config.ValidateConfig
+// rejects another config.InfluxDBDatabaseName) and the data frames carry their times in ms whatever config.InfluxDBEpoch
+func (g *GrafanaProxy) influxQLDSQuery(queryString string, resultFormat string) dsQuery {
+	return dsQuery{
+		datasource:    g.queryDatasource,
+		intervalMs:    defaultIntervalMs,
+		maxDataPoints: defaultMaxDataPoints,
+		model:         map[string]interface{}{"query": queryString, "rawQuery": true, "resultFormat": resultFormat},
+	}
+}
+
+func (g *GrafanaProxy) timescaleDSQuery(queryString string, intervalMs int64, maxDataPoints int64, format string) dsQuery {
+	return dsQuery{
+		datasource:    g.queryDatasource,
+		intervalMs:    intervalMs,
+		maxDataPoints: maxDataPoints,
+		// The SQL queries are written to be embedded as-is in the legacy JSON body
+		model: map[string]interface{}{"rawSql": strings.Replace(queryString, `\"`, `"`, -1), "format": format, "rawQuery": true},
+	}
+}
+
+// dsQueryDefaultTimeRange returns the range (in ms) used for the queries that carry their own range
+func dsQueryDefaultTimeRange() (int64, int64) {
+	now := time.Now().Unix()
+	return (now - dsQueryDefaultRange) * 1000, now * 1000
+}
@@ -2,40 +2,40 @@ package datasource
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
-	"strings"
 	"time"
 
+	"github.com/aleveille/tems/archive"
 	"github.com/aleveille/tems/config"
-	"github.com/aleveille/tems/dataout"
 	appError "github.com/aleveille/tems/error"
+	"github.com/aleveille/tems/httpclient"
 	log "github.com/aleveille/tems/logger"
 )
 
 var (
 	// GrafanaProxyInstance is the globally accessible GrafanaProxy struct
-	GrafanaProxyInstance GrafanaProxy
-	grafanaCookie        = "tdb"
-	cookieRegexp         = regexp.MustCompile("(grafana_session=[^;]*).*Max-Age=([0-9]*)")
+	GrafanaProxyInstance *GrafanaProxy
+
+	// The Grafana datasource proxy, the paths below are relative to it (or to config.TSDBURL when querying the TSDB directly)
+	// The datasource IDs are resolved at startup, see discoverDatasources()
+	grafanaDatasourceProxyURL = "%s/api/datasources/proxy/%d"
 
 	// IRONdb (CAQL) specific variables:
-	caqlQueryURL = "%s/api/datasources/proxy/1/extension/lua/caql_v1?format=DF4&start=%d&end=%d&period=60&q=%s"
-	// Response body ~= "data":[[6000]],"meta"....
-	// Match everything from the double [[ until a ]
-	caqlResultRegex          = regexp.MustCompile("data\":\\[\\[([^\\]]*)")
-	influxLastResultRegex    = regexp.MustCompile(".*,\\[[0-9]*,([0-9\\.]*)\\]")
-	fluxLastResultRegex      = regexp.MustCompile("(?s).*,([0-9\\.]*)")
-	timescaleLastResultRegex = regexp.MustCompile("(?s).*\\[([0-9\\.]+),[0-9\\.]+")
+	caqlQueryPath = "/extension/lua/caql_v1?format=DF4&start=%d&end=%d&period=%d&q=%s"
 
 	// InfluxDB specific variables:
-	influxdbQueryURL = "%s/api/datasources/proxy/1/query?db=%s&q=%s%%20&epoch=%s" // Source 1 = InfluxDB current plugin (InfluxQL)
-	fluxdbQueryURL   = "%s/api/datasources/proxy/2/flux/api/v2/query?org=my-org"  // Source 2 = InfluxDB beta Flux plugin
+	influxdbQueryPath = "/query?db=%s&q=%s%%20&epoch=%s"
+	fluxdbQueryPath   = "/flux/api/v2/query?org=my-org"
+
+	// Defaults used by the non-sweep queries
+	defaultCAQLPeriod    = int64(60)
+	defaultIntervalMs    = int64(60000)
+	defaultMaxDataPoints = int64(960)
 
 	// Timescale specific variables:
 	timescaleQueryURL  = "%s/api/tsdb/query"
@@ -46,69 +46,73 @@ var (
 			{
 				"refId":"A",
 				"intervalMs":%d,
-				"maxDataPoints":960,
-				"datasourceId":1,
+				"maxDataPoints":%d,
+				"datasourceId":%d,
 				"rawSql":"%s",
-				"format":"time_series"
+				"format":"%s"
 			}]
 		}`
 )
 
 // GrafanaProxy is our wrapper to provide higher-level functionnality to the Grafana API
-// It maintains its HTTP session (through a cookie) and will create JSON API requests to the Grafana API
+// It maintains its HTTP session (through a cookie, or a token/basic auth depending on config.GrafanaAuthMode)
+// and will create JSON API requests to the Grafana API
 type GrafanaProxy struct {
-	httpAPIclient *http.Client
+	httpAPIclient   *http.Client
+	queryDatasource grafanaDatasource  // IRONdb, InfluxDB (InfluxQL) or PostgreSQL
+	fluxDatasource  *grafanaDatasource // InfluxDB Flux, nil unless config.GrafanaFluxDatasource is set
+
+	session grafanaSession
 }
 
 // InitGrafanaProxy initialize the GrafanaProxy struct in order to interact with Grafana API
 func InitGrafanaProxy() (*GrafanaProxy, error) {
 	log.Debug("InitGrafanaProxy() start")
 	defer log.Debug("InitGrafanaProxy() end")
-	proxy := GrafanaProxy{}
+	proxy := &GrafanaProxy{}
 
 	grafanaHTTPAPIclient := grafanaHTTPAPIclientSetup()
 	proxy.httpAPIclient = grafanaHTTPAPIclient
 
-	err := proxy.login()
+	var err error
+	if config.GrafanaAuthMode == "password" {
+		err = proxy.startSession()
+	} else {
+		err = proxy.verifyCredentials()
+	}
+	if err != nil {
+		return proxy, appError.NewInitializationError("Error while logging in to Grafana", err)
+	}
+
+	err = proxy.discoverDatasources()
 	if err != nil {
-		return &proxy, appError.NewInitializationError("Error while logging in to Grafana", err)
+		return proxy, err
 	}
 
 	GrafanaProxyInstance = proxy
-	return &proxy, nil
+	return proxy, nil
 }
 
 func grafanaHTTPAPIclientSetup() *http.Client {
-	httpTransport := &http.Transport{
-		DisableCompression: true,
-		MaxConnsPerHost:    0,
-		Dial: (&net.Dialer{
-			Timeout: 500 * time.Millisecond,
-		}).Dial,
-		IdleConnTimeout:       500 * time.Millisecond,
-		ResponseHeaderTimeout: 1000 * time.Millisecond,
-		TLSHandshakeTimeout:   1000 * time.Millisecond,
-	}
-
-	grafanaHTTPAPIclient := &http.Client{
-		Timeout:   20 * time.Second,
-		Transport: httpTransport,
-	}
-
-	return grafanaHTTPAPIclient
+	return httpclient.New(httpclient.GrafanaClient, httpclient.Settings{
+		Timeout:             config.HTTPQueryTimeout,
+		DialTimeout:         500 * time.Millisecond,
+		TLSHandshakeTimeout: 1000 * time.Millisecond,
+		Sandbox:             true,
+	})
 }
 
-func (g *GrafanaProxy) login() error {
-	log.Trace("Grafana login() start")
-	defer log.Trace("Grafana login() end")
-	loginURL := fmt.Sprintf("%s/login", config.GrafanaURL)
+// verifyCredentials checks the token or basic auth credentials against the current organization endpoint,
+// which is readable by API keys and service account tokens of any role
+func (g *GrafanaProxy) verifyCredentials() error {
+	log.Trace("Grafana verifyCredentials() start")
+	defer log.Trace("Grafana verifyCredentials() end")
 
-	payload := []byte(fmt.Sprintf(`{"user":"%s","email":"","password":"%s"}`, config.GrafanaUser, config.GrafanaPassword))
-	req, err := http.NewRequest("POST", loginURL, bytes.NewBuffer(payload))
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/api/org", config.GrafanaURL), nil)
 	if err != nil {
 		return appError.NewInitializationError("error creating the HTTP request", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	g.authenticate(req)
 
 	response, err := g.httpAPIclient.Do(req)
 	if response != nil {
@@ -116,323 +120,275 @@ func (g *GrafanaProxy) login() error {
 	}
 
 	if err != nil {
-		return appError.NewInitializationError("error while sending the login request", err)
+		return appError.NewInitializationError("error while sending the credentials check request", err)
 	}
 	if response.StatusCode >= 400 {
-		return appError.NewInitializationError(fmt.Sprintf("error while sending the login request. HTTP status: %d", response.StatusCode), nil)
+		return appError.NewInitializationError(fmt.Sprintf("Grafana rejected the %s credentials. HTTP status: %d", config.GrafanaAuthMode, response.StatusCode), nil)
 	}
 
-	// TODO: This part seems brittle using hardcoded array index access (response.Header["Set-Cookie"][0], grafanaCookie = match[1] & strconv.Atoi(match[2])
-	// It's probably possible to refactor this to something cleaner
-	// Also todo: break the parsing of the response headers into another func
-	if response.Header["Set-Cookie"] != nil {
-		headerCookie := response.Header["Set-Cookie"][0]
-		match := cookieRegexp.FindStringSubmatch(headerCookie)
-
-		if len(match) < 3 {
-			return appError.NewInitializationError(fmt.Sprintf("unexpected match length for login cookie. response.Header[\"Set-Cookie\"]=%s", response.Header["Set-Cookie"]), nil)
-		}
-
-		grafanaCookie = match[1]
+	// API keys and service account tokens belong to a single organization, they can't switch to another one
+	var org struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&org); err != nil {
+		return appError.NewInitializationError("unexpected Grafana organization response body", err)
+	}
+	if config.GrafanaOrgID != 0 && org.ID != config.GrafanaOrgID {
+		return appError.NewInitializationError(fmt.Sprintf("the %s credentials give access to the Grafana organization %d (%s), not %d", config.GrafanaAuthMode, org.ID, org.Name, config.GrafanaOrgID), nil)
+	}
 
-		maxage, parseErr := strconv.Atoi(match[2])
-		if parseErr != nil || maxage < 5 {
-			maxage = 5 // retry in 5s
-			log.Warn("Grafana: Unexpected maxage value in the cookie response header. Defaulting to 5s.")
-		}
+	log.Debugf("Grafana: Successfully authenticated using %s auth in organization %d (%s)", config.GrafanaAuthMode, org.ID, org.Name)
+	return nil
+}
 
-		log.Debugf("Grafana: Successfully logged in. Cookie valid for %d seconds", maxage)
+// authenticate adds the credentials of the configured auth mode (and the organization, if any) to the request
+func (g *GrafanaProxy) authenticate(req *http.Request) {
+	if config.GrafanaOrgID != 0 {
+		req.Header.Set("X-Grafana-Org-Id", strconv.Itoa(config.GrafanaOrgID))
+	}
 
-		relogTimer := time.NewTimer(time.Duration(maxage) * time.Second)
-		go func() {
-			<-relogTimer.C
-			g.login()
-		}()
+	switch config.GrafanaAuthMode {
+	case "token":
+		req.Header.Set("Authorization", "Bearer "+config.GrafanaAPIToken)
+	case "basic":
+		req.SetBasicAuth(config.GrafanaUser, config.GrafanaPassword)
+	default:
+		req.Header.Set("cookie", g.sessionCookie())
 	}
-	return nil
 }
 
-// TODO: Review if this needs refactoring (spoiler: it does)
+// SimpleCaqlQuery will time a CAQL query over the given range (in seconds) using the default period
 func (g *GrafanaProxy) SimpleCaqlQuery(queryMetricName string, caqlQuery string, queryRange int64) {
-	queryStartTime := time.Now()
+	g.SweepCaqlQuery(queryMetricName, caqlQuery, queryRange, defaultCAQLPeriod)
+}
 
-	queryDuration := "nan"
+// SweepCaqlQuery will time a CAQL query over the given range using the given period (both in seconds)
+func (g *GrafanaProxy) SweepCaqlQuery(queryMetricName string, caqlQuery string, queryRange int64, period int64) {
+	timeQuery(queryMetricName,
+		func(queryTimestamp int64) (string, error) {
+			return g.doProxiedCAQLHTTPQuery(caqlQuery, queryTimestamp-queryRange, queryTimestamp, period)
+		},
+		func(queryTimestamp int64) (string, error) {
+			return TSDBProxyInstance.doDirectCAQLHTTPQuery(caqlQuery, queryTimestamp-queryRange, queryTimestamp, period)
+		})
+}
 
-	queryTimestamp := queryStartTime.Unix()
-	result, err := g.doProxiedCAQLHTTPQuery(caqlQuery, queryTimestamp-queryRange, queryTimestamp)
+// doProxiedHTTPRequest will send the request to Grafana and return the response body
+// proxyName is only used to give some context in the error messages (eg: CAQL, InfluxDB)
+// With a session cookie, a 401 or 403 response renews the session and the request is retried once. A 403 that
+// outlives the renewal is a missing permission (eg: on the datasource), the next 403s of that session aren't retried
+func (g *GrafanaProxy) doProxiedHTTPRequest(req *http.Request, proxyName string) ([]byte, error) {
+	generation := g.sessionGeneration()
 
-	if err != nil {
-		result = "nan"
-		log.Errorf("Error while querying Grafana:\n%v\n", err)
-	} else {
-		queryDurationFloat := float64(time.Now().UnixNano()-queryStartTime.UnixNano()) / 1000 / 1000
-		queryDuration = fmt.Sprintf("%.2f", queryDurationFloat)
-	}
+	body, statusCode, err := g.sendProxiedHTTPRequest(req, proxyName)
+	renew := statusCode == http.StatusUnauthorized || (statusCode == http.StatusForbidden && !g.forbiddenAfterRenewal(generation))
+	if renew && config.GrafanaAuthMode == "password" {
+		log.Warnf("Grafana: HTTP status %d from the %s proxy, renewing the session", statusCode, proxyName)
 
-	select {
-	case dataout.ResultChan <- dataout.Result{Timestamp: queryTimestamp, Name: fmt.Sprintf("%s.query.%s.duration", config.SandboxID, queryMetricName), Value: queryDuration}:
-	default:
-		log.Error("Channel full, discarding result")
-	}
-	select {
-	case dataout.ResultChan <- dataout.Result{Timestamp: queryTimestamp, Name: fmt.Sprintf("%s.query.%s.value", config.SandboxID, queryMetricName), Value: result}:
-	default:
-		log.Error("Channel full, discarding result")
+		if renewErr := g.renewSession(generation); renewErr != nil {
+			return nil, fmt.Errorf("%s\n\tthe session renewal failed too: %s", err, renewErr)
+		}
+
+		retryReq, cloneErr := cloneRequest(req)
+		if cloneErr != nil {
+			return nil, cloneErr
+		}
+		retryGeneration := g.sessionGeneration()
+		body, statusCode, err = g.sendProxiedHTTPRequest(retryReq, proxyName)
+		if statusCode == http.StatusForbidden {
+			g.setForbiddenAfterRenewal(retryGeneration)
+		}
 	}
+
+	return body, err
 }
 
-// TODO: Review if this needs refactoring (spoiler: it does)
-func (g *GrafanaProxy) doProxiedCAQLHTTPQuery(queryString string, startTimestamp int64, endTimestamp int64) (string, error) {
-	var netClient = &http.Client{
-		Timeout: time.Second * 25,
-	}
+// sendProxiedHTTPRequest sends the request once and returns the response body and HTTP status code (0 if there was no response)
+func (g *GrafanaProxy) sendProxiedHTTPRequest(req *http.Request, proxyName string) ([]byte, int, error) {
+	g.authenticate(req)
 
-	formattedCaqlURL := fmt.Sprintf(caqlQueryURL, config.GrafanaURL, startTimestamp, endTimestamp, queryString)
-	req, _ := http.NewRequest("GET", formattedCaqlURL, nil)
-	req.Header.Add("cookie", grafanaCookie)
-	req.Header.Add("x-circonus-account", "1")
+	log.Tracef("%s request sent to Grafana: URL=%v, Cookies=%v", req.Method, req.URL, req.Cookies())
 
-	response, err := netClient.Do(req)
+	requestStartTime := time.Now()
+	response, err := g.httpAPIclient.Do(req)
 	if response != nil {
 		defer response.Body.Close()
 	}
 
 	if err != nil {
-		return "nan", fmt.Errorf("net/client request error while querying the Grafana CAQL proxy:\n\t%s", err)
-	}
-	if response.StatusCode >= 400 {
-		return "nan", fmt.Errorf("unexpected HTTP status code error while querying the Grafana CAQL proxy. HTTP status: %d", response.StatusCode)
+		archive.RecordHTTP(httpclient.GrafanaClient, req, nil, nil, time.Since(requestStartTime), err)
+		return nil, 0, fmt.Errorf("net/client request error while querying the Grafana %s proxy:\n\t%s", proxyName, err)
 	}
 
+	// The body of the failed requests is read as well, for the archive
 	body, ioErr := ioutil.ReadAll(response.Body)
+	archive.RecordHTTP(httpclient.GrafanaClient, req, response, body, time.Since(requestStartTime), ioErr)
+
+	if response.StatusCode >= 400 {
+		return nil, response.StatusCode, fmt.Errorf("unexpected HTTP status code error while querying the Grafana %s proxy. HTTP status: %d", proxyName, response.StatusCode)
+	}
 	if ioErr != nil {
-		return "nan", fmt.Errorf("io error while reading HTTP response body:\n%s", ioErr)
+		return nil, response.StatusCode, fmt.Errorf("io error while reading HTTP response body:\n%s", ioErr)
 	}
 
-	stringBody := string(body)
-	match := caqlResultRegex.FindStringSubmatch(stringBody)
+	return body, response.StatusCode, nil
+}
 
-	if len(match) < 2 {
-		return "nan", nil
+// cloneRequest returns a copy of the request with a fresh body, so it can be sent again
+func cloneRequest(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("error while copying the request body for the retry:\n\t%s", err)
+		}
+		clone.Body = body
 	}
 
-	datapoints := strings.Split(match[1], ",")
-	lastCount := datapoints[len(datapoints)-1]
-	return lastCount, nil
+	return clone, nil
 }
 
-func (g *GrafanaProxy) SimpleInfluxDBQuery(queryMetricName string, queryString string, queryRange string) {
-	queryStartTime := time.Now()
+// datasourceProxyURL returns the base URL of the Grafana proxy for the given datasource
+func datasourceProxyURL(datasource grafanaDatasource) string {
+	return fmt.Sprintf(grafanaDatasourceProxyURL, config.GrafanaURL, datasource.ID)
+}
 
-	queryDuration := "nan"
+func (g *GrafanaProxy) doProxiedCAQLHTTPQuery(queryString string, startTimestamp int64, endTimestamp int64, period int64) (string, error) {
+	if config.GrafanaQueryAPI == "ds" {
+		query, err := g.caqlDSQuery(queryString, period)
+		if err != nil {
+			return "nan", err
+		}
+		return g.doDSQuery(query, startTimestamp*1000, endTimestamp*1000)
+	}
 
-	queryTimestamp := queryStartTime.Unix()
-	result, err := g.doProxiedInfluxDBHTTPQuery(config.InfluxDBDatabaseName, queryString, queryRange, config.InfluxDBEpoch)
+	formattedCaqlURL := datasourceProxyURL(g.queryDatasource) + fmt.Sprintf(caqlQueryPath, startTimestamp, endTimestamp, period, queryString)
+	req, _ := http.NewRequest("GET", formattedCaqlURL, nil)
+	req.Header.Add("x-circonus-account", config.IRONdbAccountID)
 
+	body, err := g.doProxiedHTTPRequest(req, "CAQL")
 	if err != nil {
-		result = "nan"
-		log.Errorf("Error while querying Grafana:\n%v\n", err)
-	} else {
-		queryDurationFloat := float64(time.Now().UnixNano()-queryStartTime.UnixNano()) / 1000 / 1000
-		queryDuration = fmt.Sprintf("%.2f", queryDurationFloat)
+		return "nan", err
 	}
 
-	select {
-	case dataout.ResultChan <- dataout.Result{Timestamp: queryTimestamp, Name: fmt.Sprintf("%s.query.%s.duration", config.SandboxID, queryMetricName), Value: queryDuration}:
-	default:
-		log.Error("Channel full, discarding result")
-	}
-	select {
-	case dataout.ResultChan <- dataout.Result{Timestamp: queryTimestamp, Name: fmt.Sprintf("%s.query.%s.value", config.SandboxID, queryMetricName), Value: result}:
-	default:
-		log.Error("Channel full, discarding result")
-	}
+	return parseCAQLResponse(body)
 }
 
-func (g *GrafanaProxy) doProxiedInfluxDBHTTPQuery(db string, queryString string, queryRange string, epoch string) (string, error) {
-	var netClient = &http.Client{
-		Timeout: time.Second * 25,
-	}
-
+// SimpleInfluxDBQuery will time an InfluxQL query. The query string must contain a %s verb for the range (eg: 7d)
+func (g *GrafanaProxy) SimpleInfluxDBQuery(queryMetricName string, queryString string, queryRange string) {
 	rangeQuery := fmt.Sprintf(queryString, queryRange)
-	formattedQueryURL := fmt.Sprintf(influxdbQueryURL, config.GrafanaURL, db, url.PathEscape(rangeQuery), epoch)
 
-	req, _ := http.NewRequest("GET", formattedQueryURL, nil)
-	req.Header.Add("cookie", grafanaCookie)
+	timeQuery(queryMetricName,
+		func(queryTimestamp int64) (string, error) {
+			return g.doProxiedInfluxDBHTTPQuery(config.InfluxDBDatabaseName, rangeQuery, config.InfluxDBEpoch)
+		},
+		func(queryTimestamp int64) (string, error) {
+			return TSDBProxyInstance.doDirectInfluxDBHTTPQuery(config.InfluxDBDatabaseName, rangeQuery, config.InfluxDBEpoch)
+		})
+}
 
-	log.Tracef("Request sent to Grafana: URL=%v, Cookies=%v", req.URL, req.Cookies())
+func (g *GrafanaProxy) doProxiedInfluxDBHTTPRequest(db string, queryString string, epoch string) ([]byte, error) {
+	formattedQueryURL := datasourceProxyURL(g.queryDatasource) + fmt.Sprintf(influxdbQueryPath, db, url.PathEscape(queryString), epoch)
 
-	response, err := netClient.Do(req)
-	if response != nil {
-		defer response.Body.Close()
-	}
+	req, _ := http.NewRequest("GET", formattedQueryURL, nil)
 
-	if err != nil {
-		return "nan", fmt.Errorf("net/client request error while querying the Grafana InfluxDB proxy:\n\t%s", err)
-	}
-	if response.StatusCode >= 400 {
-		return "nan", fmt.Errorf("unexpected HTTP status code error while querying the Grafana InfluxDB proxy. HTTP status: %d", response.StatusCode)
-	}
+	return g.doProxiedHTTPRequest(req, "InfluxDB")
+}
 
-	body, ioErr := ioutil.ReadAll(response.Body)
-	if ioErr != nil {
-		return "nan", fmt.Errorf("io error while reading HTTP response body:\n%s", ioErr)
+func (g *GrafanaProxy) doProxiedInfluxDBHTTPQuery(db string, queryString string, epoch string) (string, error) {
+	if config.GrafanaQueryAPI == "ds" {
+		// The database and epoch are part of the datasource configuration
+		startTimestamp, endTimestamp := dsQueryDefaultTimeRange()
+		return g.doDSQuery(g.influxQLDSQuery(queryString, "time_series"), startTimestamp, endTimestamp)
 	}
 
-	stringBody := string(body)
-	match := influxLastResultRegex.FindStringSubmatch(stringBody)
-
-	if len(match) < 2 {
-		fmt.Println("No match error:")
-		fmt.Println(rangeQuery)
-		fmt.Println(stringBody)
-
-		return "nan", nil
+	body, err := g.doProxiedInfluxDBHTTPRequest(db, queryString, epoch)
+	if err != nil {
+		return "nan", err
 	}
 
-	datapoints := strings.Split(match[1], ",")
-	lastCount := datapoints[len(datapoints)-1]
-	return lastCount, nil
+	return parseInfluxDBResponse(body, queryString)
 }
 
+// FluxDBQuery will time a Flux query
 func (g *GrafanaProxy) FluxDBQuery(queryMetricName string, queryString string) {
-	queryStartTime := time.Now()
-
-	queryDuration := "nan"
-
-	queryTimestamp := queryStartTime.Unix()
-	result, err := g.doProxiedFluxDBHTTPQuery(config.InfluxDBDatabaseName, queryString)
-
-	if err != nil {
-		result = "nan"
-		log.Errorf("Error while querying Grafana:\n%v\n", err)
-	} else {
-		queryDurationFloat := float64(time.Now().UnixNano()-queryStartTime.UnixNano()) / 1000 / 1000
-		queryDuration = fmt.Sprintf("%.2f", queryDurationFloat)
-	}
+	timeQuery(queryMetricName,
+		func(queryTimestamp int64) (string, error) {
+			return g.doProxiedFluxDBHTTPQuery(queryString)
+		},
+		func(queryTimestamp int64) (string, error) {
+			return TSDBProxyInstance.doDirectFluxDBHTTPQuery(queryString)
+		})
+}
 
-	select {
-	case dataout.ResultChan <- dataout.Result{Timestamp: queryTimestamp, Name: fmt.Sprintf("%s.query.%s.duration", config.SandboxID, queryMetricName), Value: queryDuration}:
-	default:
-		log.Error("Channel full, discarding result")
+func (g *GrafanaProxy) doProxiedFluxDBHTTPQuery(queryString string) (string, error) {
+	if g.fluxDatasource == nil {
+		return "nan", fmt.Errorf("no Grafana Flux datasource configured (see grafanaFluxDatasource)")
 	}
-	select {
-	case dataout.ResultChan <- dataout.Result{Timestamp: queryTimestamp, Name: fmt.Sprintf("%s.query.%s.value", config.SandboxID, queryMetricName), Value: result}:
-	default:
-		log.Error("Channel full, discarding result")
-	}
-}
 
-func (g *GrafanaProxy) doProxiedFluxDBHTTPQuery(db string, queryString string) (string, error) {
-	var netClient = &http.Client{
-		Timeout: time.Second * 25,
+	if config.GrafanaQueryAPI == "ds" {
+		startTimestamp, endTimestamp := dsQueryDefaultTimeRange()
+		query := dsQuery{
+			datasource:    *g.fluxDatasource,
+			intervalMs:    defaultIntervalMs,
+			maxDataPoints: defaultMaxDataPoints,
+			model:         map[string]interface{}{"query": queryString},
+		}
+		return g.doDSQuery(query, startTimestamp, endTimestamp)
 	}
 
-	formattedQueryURL := fmt.Sprintf(fluxdbQueryURL, config.GrafanaURL)
+	formattedQueryURL := datasourceProxyURL(*g.fluxDatasource) + fluxdbQueryPath
 
 	req, _ := http.NewRequest("POST", formattedQueryURL, bytes.NewBuffer([]byte(queryString)))
-	req.Header.Add("cookie", grafanaCookie)
 	req.Header.Set("Content-Type", "application/vnd.flux")
-	req.Header.Set("X-Grafana-Org-Id", "1")
 	req.Header.Set("Accept", "application/csv")
 
-	log.Tracef("POST request sent to Grafana: URL=%v, Cookies=%v, Body=%v", req.URL, req.Cookies(), req.Body)
-
-	response, err := netClient.Do(req)
-	if response != nil {
-		defer response.Body.Close()
-	}
-
+	body, err := g.doProxiedHTTPRequest(req, "InfluxDB")
 	if err != nil {
-		return "nan", fmt.Errorf("net/client request error while querying the Grafana InfluxDB proxy:\n\t%s", err)
-	}
-	if response.StatusCode >= 400 {
-		return "nan", fmt.Errorf("unexpected HTTP status code error while querying the Grafana InfluxDB proxy. HTTP status: %d", response.StatusCode)
-	}
-
-	body, ioErr := ioutil.ReadAll(response.Body)
-	if ioErr != nil {
-		return "nan", fmt.Errorf("io error while reading HTTP response body:\n%s", ioErr)
-	}
-
-	stringBody := string(body)
-	match := fluxLastResultRegex.FindStringSubmatch(stringBody)
-
-	if len(match) < 2 {
-		return "nan", nil
+		return "nan", err
 	}
 
-	return match[1], nil
+	return parseFluxResponse(body)
 }
 
+// TimescaleDBQuery will time a Timescale query over the given range (in seconds) using the default interval
 func (g *GrafanaProxy) TimescaleDBQuery(queryMetricName string, queryString string, queryRange int64) {
-	queryStartTime := time.Now()
-
-	queryDuration := "nan"
-
-	queryTimestamp := queryStartTime.Unix()
-
-	result, err := g.doProxiedTimescaleDBHTTPQuery(queryString, (queryTimestamp-queryRange)*1000, queryTimestamp*1000)
-
-	if err != nil {
-		result = "nan"
-		log.Errorf("Error while querying Grafana:\n%v\n", err)
-	} else {
-		queryDurationFloat := float64(time.Now().UnixNano()-queryStartTime.UnixNano()) / 1000 / 1000
-		queryDuration = fmt.Sprintf("%.2f", queryDurationFloat)
-	}
-
-	select {
-	case dataout.ResultChan <- dataout.Result{Timestamp: queryTimestamp, Name: fmt.Sprintf("%s.query.%s.duration", config.SandboxID, queryMetricName), Value: queryDuration}:
-	default:
-		log.Error("Channel full, discarding result")
-	}
-	select {
-	case dataout.ResultChan <- dataout.Result{Timestamp: queryTimestamp, Name: fmt.Sprintf("%s.query.%s.value", config.SandboxID, queryMetricName), Value: result}:
-	default:
-		log.Error("Channel full, discarding result")
-	}
+	g.SweepTimescaleDBQuery(queryMetricName, queryString, queryRange, defaultIntervalMs, defaultMaxDataPoints)
 }
 
-func (g *GrafanaProxy) doProxiedTimescaleDBHTTPQuery(queryString string, startTimestamp int64, endTimestamp int64) (string, error) {
-	var netClient = &http.Client{
-		Timeout: time.Second * 25,
-	}
+// SweepTimescaleDBQuery will time a Timescale query over the given range (in seconds) using the given interval (in ms) and max data points
+func (g *GrafanaProxy) SweepTimescaleDBQuery(queryMetricName string, queryString string, queryRange int64, intervalMs int64, maxDataPoints int64) {
+	timeQuery(queryMetricName,
+		func(queryTimestamp int64) (string, error) {
+			return g.doProxiedTimescaleDBHTTPQuery(queryString, (queryTimestamp-queryRange)*1000, queryTimestamp*1000, intervalMs, maxDataPoints)
+		},
+		func(queryTimestamp int64) (string, error) {
+			return TSDBProxyInstance.doDirectTimescaleDBQuery(queryString, (queryTimestamp-queryRange)*1000, queryTimestamp*1000, intervalMs)
+		})
+}
 
+// doProxiedTimescaleDBHTTPRequest will send the query to the Grafana tsdb API. The format is either "time_series" or "table"
+func (g *GrafanaProxy) doProxiedTimescaleDBHTTPRequest(queryString string, startTimestamp int64, endTimestamp int64, intervalMs int64, maxDataPoints int64, format string) ([]byte, error) {
 	formattedQueryURL := fmt.Sprintf(timescaleQueryURL, config.GrafanaURL)
-	formattedQueryBody := fmt.Sprintf(timescaleQueryBody, startTimestamp, endTimestamp, 60000, queryString)
+	formattedQueryBody := fmt.Sprintf(timescaleQueryBody, startTimestamp, endTimestamp, intervalMs, maxDataPoints, g.queryDatasource.ID, queryString, format)
 
 	req, _ := http.NewRequest("POST", formattedQueryURL, bytes.NewBuffer([]byte(formattedQueryBody)))
-	req.Header.Add("cookie", grafanaCookie)
 	req.Header.Set("Content-Type", "application/json;charset=utf-8")
-	req.Header.Set("X-Grafana-Org-Id", "1")
 	req.Header.Set("Accept", "application/json, text/plain, */*")
 
-	log.Tracef("POST request sent to Grafana: URL=%v, Cookies=%v, Body=%v", req.URL, req.Cookies(), req.Body)
+	return g.doProxiedHTTPRequest(req, "Timescale")
+}
 
-	response, err := netClient.Do(req)
-	if response != nil {
-		defer response.Body.Close()
+func (g *GrafanaProxy) doProxiedTimescaleDBHTTPQuery(queryString string, startTimestamp int64, endTimestamp int64, intervalMs int64, maxDataPoints int64) (string, error) {
+	if config.GrafanaQueryAPI == "ds" {
+		return g.doDSQuery(g.timescaleDSQuery(queryString, intervalMs, maxDataPoints, "time_series"), startTimestamp, endTimestamp)
 	}
 
+	body, err := g.doProxiedTimescaleDBHTTPRequest(queryString, startTimestamp, endTimestamp, intervalMs, maxDataPoints, "time_series")
 	if err != nil {
-		return "nan", fmt.Errorf("net/client request error while querying the Grafana Timescale proxy:\n\t%s", err)
-	}
-	if response.StatusCode >= 400 {
-		return "nan", fmt.Errorf("unexpected HTTP status code error while querying the Grafana Timescale proxy. HTTP status: %d", response.StatusCode)
-	}
-
-	body, ioErr := ioutil.ReadAll(response.Body)
-	if ioErr != nil {
-		return "nan", fmt.Errorf("io error while reading HTTP response body:\n%s", ioErr)
-	}
-
-	stringBody := string(body)
-	match := timescaleLastResultRegex.FindStringSubmatch(stringBody)
-
-	if len(match) < 2 {
-		return "nan", nil
+		return "nan", err
 	}
 
-	return match[1], nil
+	return parseTimescaleResponse(body)
 }
@@ -0,0 +1,143 @@
+package datasource
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aleveille/tems/archive"
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/dataout"
+	appError "github.com/aleveille/tems/error"
+	"github.com/aleveille/tems/httpclient"
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	// InfraProxyInstance is the globally accessible InfraProxy struct
+	InfraProxyInstance InfraProxy
+)
+
+// InfraProxy collects the infra metrics of the TSDB nodes from node_exporter, Prometheus or the local /proc and cgroups,
+// for the sandboxes without CloudWatch (bare metal, Kubernetes, a workstation). The metrics have the same names as the
+// CloudWatch ones (infra.tsdb-node-N.*), node N being the Nth one of config.InfraNodeList
+type InfraProxy struct {
+	httpAPIclient *http.Client
+
+	// The previous samples of each node, the counters are turned into rates between two scrapes
+	samplesMutex *sync.Mutex
+	samples      []*nodeExporterSample
+	localSamples []*localSample
+
+	localTargets []localTarget
+}
+
+// InitInfraProxy initialize the InfraProxy struct in order to collect the infra metrics
+func InitInfraProxy() (*InfraProxy, error) {
+	log.Debug("InitInfraProxy() start")
+	defer log.Debug("InitInfraProxy() end")
+
+	proxy := InfraProxy{
+		httpAPIclient: httpclient.New(httpclient.InfraClient, httpclient.Settings{
+			Timeout:             10 * time.Second,
+			DialTimeout:         500 * time.Millisecond,
+			TLSHandshakeTimeout: 1000 * time.Millisecond,
+			Sandbox:             true,
+		}),
+		samplesMutex: &sync.Mutex{},
+		samples:      make([]*nodeExporterSample, len(config.InfraNodeList)),
+		localSamples: make([]*localSample, len(config.InfraNodeList)),
+	}
+
+	if config.InfraSource == "local" {
+		for _, node := range config.InfraNodeList {
+			target, err := parseLocalTarget(node)
+			if err != nil {
+				return &proxy, appError.NewInitializationError("invalid local infra target", err)
+			}
+			proxy.localTargets = append(proxy.localTargets, target)
+		}
+	}
+
+	InfraProxyInstance = proxy
+	return &proxy, nil
+}
+
+// CollectInfraMetrics pushes the infra metrics of every node to the result channel
+func (i *InfraProxy) CollectInfraMetrics() {
+	switch config.InfraSource {
+	case "node_exporter":
+		for nodeIndex, metricsURL := range config.InfraNodeList {
+			go i.scrapeNodeExporter(nodeIndex, metricsURL)
+		}
+	case "prometheus":
+		i.queryPrometheus()
+	case "local":
+		for nodeIndex, target := range i.localTargets {
+			go i.collectLocalTarget(nodeIndex, target)
+		}
+	}
+}
+
+func (i *InfraProxy) doHTTPRequest(req *http.Request, apiName string) ([]byte, error) {
+	log.Tracef("%s request sent to the infra source: URL=%v", req.Method, req.URL)
+
+	requestStartTime := time.Now()
+	response, err := i.httpAPIclient.Do(req)
+	if response != nil {
+		defer response.Body.Close()
+	}
+
+	if err != nil {
+		archive.RecordHTTP(httpclient.InfraClient, req, nil, nil, time.Since(requestStartTime), err)
+		return nil, fmt.Errorf("net/client request error while calling the %s API:\n\t%s", apiName, err)
+	}
+
+	// The body of the failed requests is read as well, for the archive
+	body, ioErr := ioutil.ReadAll(response.Body)
+	archive.RecordHTTP(httpclient.InfraClient, req, response, body, time.Since(requestStartTime), ioErr)
+
+	if response.StatusCode >= 400 {
+		return nil, fmt.Errorf("unexpected HTTP status code error while calling the %s API. HTTP status: %d", apiName, response.StatusCode)
+	}
+	if ioErr != nil {
+		return nil, fmt.Errorf("io error while reading HTTP response body:\n%s", ioErr)
+	}
+
+	return body, nil
+}
+
+// nodeCounter is a counter read twice, turned into a per-minute value by pushNodeCounters()
+type nodeCounter struct {
+	metricName string
+	current    float64
+	previous   float64
+}
+
+// pushNodeCounters pushes the per-minute values of counters read elapsedSeconds apart, like the 1-minute CloudWatch sums
+func pushNodeCounters(nodeIndex int, counters []nodeCounter, elapsedSeconds float64, timestamp time.Time) {
+	for _, counter := range counters {
+		// A counter going down means the process (or the node) restarted, there's no rate until the next read
+		if counter.current < counter.previous {
+			continue
+		}
+		pushNodeResult(nodeIndex, counter.metricName, (counter.current-counter.previous)*60/elapsedSeconds, timestamp)
+	}
+}
+
+// pushNodeResult pushes an infra metric of node N (nodeIndex+1)
+func pushNodeResult(nodeIndex int, metricName string, value float64, timestamp time.Time) {
+	r := dataout.Result{
+		Timestamp: timestamp.Unix(),
+		Name:      fmt.Sprintf("%s.infra.tsdb-node-%d.%s", config.SandboxID, nodeIndex+1, metricName),
+		Value:     fmt.Sprintf("%.2f", value),
+	}
+
+	select {
+	case dataout.ResultChan <- r:
+	default:
+		log.Error("Channel full, discarding result")
+	}
+}
@@ -0,0 +1,177 @@
+package datasource
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	log "github.com/aleveille/tems/logger"
+)
+
+// The infra results are tagged with the metadata of their instances (type, availability zone, launch time and EBS
+// volume types), so the runs against different sandbox configurations can be told apart
+
+// instanceMetadata is the metadata of an instance of the sandbox
+type instanceMetadata struct {
+	InstanceType     string    `json:"instanceType"`
+	AvailabilityZone string    `json:"availabilityZone"`
+	LaunchTime       time.Time `json:"launchTime"`
+
+	// The EBS volumes by device name order
+	Volumes []volumeMetadata `json:"volumes"`
+}
+
+// volumeMetadata is the metadata of an EBS volume. Only the ID is set when the volume couldn't be described
+type volumeMetadata struct {
+	VolumeID       string `json:"volumeId"`
+	VolumeType     string `json:"volumeType,omitempty"`
+	SizeGiB        int64  `json:"sizeGiB,omitempty"`
+	Iops           int64  `json:"iops,omitempty"`
+	ThroughputMBps int64  `json:"throughputMBps,omitempty"`
+}
+
+// refreshInstanceMetadata describes the instances of the slots seen for the first time, and forgets the ones that
+// left. With config.AWSEBSVolumeMetrics, all the instances are described again, to pick up the attached volumes
+// It returns whether the metadata changed
+func (a *AWSProxy) refreshInstanceMetadata(instanceIDs []string) (bool, error) {
+	a.topology.mutex.RLock()
+	toDescribe := []string{}
+	for _, instanceID := range instanceIDs {
+		if instanceID == "" {
+			continue
+		}
+		if _, known := a.topology.instances[instanceID]; !known || config.AWSEBSVolumeMetrics {
+			toDescribe = append(toDescribe, instanceID)
+		}
+	}
+	a.topology.mutex.RUnlock()
+
+	described, err := a.describeInstances(toDescribe)
+	if err != nil {
+		return false, err
+	}
+
+	volumeIDs := []string{}
+	for _, metadata := range described {
+		for _, volume := range metadata.Volumes {
+			volumeIDs = append(volumeIDs, volume.VolumeID)
+		}
+	}
+	// Without the volumes (eg: ec2:DescribeVolumes isn't allowed), the rest of the metadata is still worth having
+	volumes, err := a.findVolumes(volumeIDs)
+	if err != nil {
+		log.Debugf("The EBS volumes couldn't be described: %v", err)
+		volumes = map[string]volumeMetadata{}
+	}
+	for _, metadata := range described {
+		for index, volume := range metadata.Volumes {
+			if volumeDescription, ok := volumes[volume.VolumeID]; ok {
+				metadata.Volumes[index] = volumeDescription
+			}
+		}
+	}
+
+	changed := false
+	a.topology.mutex.Lock()
+	for instanceID, metadata := range described {
+		if known, ok := a.topology.instances[instanceID]; !ok || !reflect.DeepEqual(known, metadata) {
+			changed = true
+		}
+		a.topology.instances[instanceID] = metadata
+	}
+	for instanceID := range a.topology.instances {
+		if indexOf(instanceIDs, instanceID) < 0 {
+			delete(a.topology.instances, instanceID)
+			changed = true
+		}
+	}
+	a.topology.mutex.Unlock()
+
+	return changed, nil
+}
+
+// setMetadataFailing records whether the instances can be described, and returns whether they couldn't already
+func (t *sandboxTopology) setMetadataFailing(failing bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	wasFailing := t.metadataFailing
+	t.metadataFailing = failing
+
+	return wasFailing
+}
+
+// InfraTags returns the tags of the ASGs, instances and EBS volumes of the sandbox, by the name of their infra results
+// (relative to the sandbox ID, eg: infra.tsdb-node-3 or infra.tsdb-node-3.ebs-volume-1)
+func (a *AWSProxy) InfraTags() map[string][]string {
+	a.topology.mutex.RLock()
+	defer a.topology.mutex.RUnlock()
+
+	tags := map[string][]string{}
+	for asgSlot, asgName := range a.topology.asgNames {
+		if asgName == "" {
+			continue
+		}
+
+		// The instance types and availability zones of the instances of the ASG
+		asgTags := map[string]bool{}
+		for index := asgSlot * a.topology.instancesPerASG; index < (asgSlot+1)*a.topology.instancesPerASG; index++ {
+			metadata, ok := a.topology.instances[a.topology.instanceIDs[index]]
+			if !ok {
+				continue
+			}
+
+			nodeTags := metadataTags(metadata)
+			tags[fmt.Sprintf("infra.tsdb-node-%d", index+1)] = nodeTags
+			for _, tag := range nodeTags {
+				if strings.HasPrefix(tag, "instance-type: ") || strings.HasPrefix(tag, "availability-zone: ") {
+					asgTags[tag] = true
+				}
+			}
+
+			for volumeIndex, volume := range metadata.Volumes {
+				if volume.VolumeType != "" {
+					tags[fmt.Sprintf("infra.tsdb-node-%d.ebs-volume-%d", index+1, volumeIndex+1)] = []string{"volume-type: " + volume.VolumeType}
+				}
+			}
+		}
+
+		tags[fmt.Sprintf("infra.tsdb-asg-%d", asgSlot+1)] = sortedKeys(asgTags)
+	}
+
+	return tags
+}
+
+// metadataTags returns the tags of an instance, in the "key: value" format of the check bundle metric tags
+func metadataTags(metadata *instanceMetadata) []string {
+	tags := map[string]bool{}
+	if metadata.InstanceType != "" {
+		tags["instance-type: "+metadata.InstanceType] = true
+	}
+	if metadata.AvailabilityZone != "" {
+		tags["availability-zone: "+metadata.AvailabilityZone] = true
+	}
+	if !metadata.LaunchTime.IsZero() {
+		tags["launch-time: "+metadata.LaunchTime.UTC().Format(time.RFC3339)] = true
+	}
+	for _, volume := range metadata.Volumes {
+		if volume.VolumeType != "" {
+			tags["volume-type: "+volume.VolumeType] = true
+		}
+	}
+
+	return sortedKeys(tags)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,390 @@
+package datasource
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/aleveille/tems/logger"
+)
+
+// The local infra source reads /proc and the cgroup v2 hierarchy of the machine tems runs on, for the single-node
+// experiments on a workstation. Each node is a process (pid:1234), all the processes with a name (name:influxd) or a
+// container (container:<id>, matched against the cgroup directory names)
+
+var (
+	procRoot   = "/proc"
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// USER_HZ, the unit of the CPU times in /proc/<pid>/stat. It is 100 on every Linux architecture we run on
+	procClockTicks = 100.0
+
+	// How deep to look for the cgroup of a container (eg: system.slice/docker-<id>.scope, kubepods/burstable/pod<uid>/<id>)
+	cgroupSearchDepth = 5
+)
+
+// localTarget is a process, a set of processes or a container of the local machine
+type localTarget struct {
+	kind  string // pid, name or container
+	value string
+}
+
+// localSample is the counters and gauges of a local target. The IO and network are missing when they can't be read
+// (eg: /proc/<pid>/io of another user's process)
+type localSample struct {
+	time time.Time
+
+	cpuSeconds float64
+	rssBytes   float64
+
+	hasIO      bool
+	readBytes  float64
+	writeBytes float64
+
+	hasNetwork      bool
+	networkInBytes  float64
+	networkOutBytes float64
+}
+
+func parseLocalTarget(node string) (localTarget, error) {
+	parts := strings.SplitN(node, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return localTarget{}, fmt.Errorf("%q should be pid:<pid>, name:<process name> or container:<id>", node)
+	}
+
+	switch parts[0] {
+	case "pid":
+		if _, err := strconv.Atoi(parts[1]); err != nil {
+			return localTarget{}, fmt.Errorf("invalid pid in %q", node)
+		}
+	case "name", "container":
+	default:
+		return localTarget{}, fmt.Errorf("%q should be pid:<pid>, name:<process name> or container:<id>", node)
+	}
+
+	return localTarget{kind: parts[0], value: parts[1]}, nil
+}
+
+// collectLocalTarget reads the stats of a local target and pushes the metrics of the node
+// The CPU is a percentage of all the CPUs of the machine, like the CPU utilization of an EC2 instance
+func (i *InfraProxy) collectLocalTarget(nodeIndex int, target localTarget) {
+	var sample *localSample
+	var err error
+
+	switch target.kind {
+	case "pid":
+		sample, err = readProcessesSample([]string{target.value})
+	case "name":
+		var pids []string
+		pids, err = findProcessesByName(target.value)
+		if err == nil {
+			sample, err = readProcessesSample(pids)
+		}
+	case "container":
+		sample, err = readContainerSample(target.value)
+	}
+	if err != nil {
+		log.Errorf("Error while reading the local stats of node %d (%s:%s):\n%s\n", nodeIndex+1, target.kind, target.value, err)
+		return
+	}
+	sample.time = time.Now()
+
+	i.samplesMutex.Lock()
+	previous := i.localSamples[nodeIndex]
+	i.localSamples[nodeIndex] = sample
+	i.samplesMutex.Unlock()
+
+	pushNodeResult(nodeIndex, "memory.rss.bytes", sample.rssBytes, sample.time)
+
+	if previous == nil {
+		return
+	}
+
+	elapsed := sample.time.Sub(previous.time).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	if sample.cpuSeconds >= previous.cpuSeconds {
+		pushNodeResult(nodeIndex, "cpu.utilization.avg", 100*(sample.cpuSeconds-previous.cpuSeconds)/(elapsed*float64(runtime.NumCPU())), sample.time)
+	}
+
+	counters := []nodeCounter{}
+	if sample.hasIO && previous.hasIO {
+		counters = append(counters, nodeCounter{"disk.read.bytes", sample.readBytes, previous.readBytes}, nodeCounter{"disk.write.bytes", sample.writeBytes, previous.writeBytes})
+	}
+	if sample.hasNetwork && previous.hasNetwork {
+		counters = append(counters, nodeCounter{"network.in.bytes", sample.networkInBytes, previous.networkInBytes}, nodeCounter{"network.out.bytes", sample.networkOutBytes, previous.networkOutBytes})
+	}
+	pushNodeCounters(nodeIndex, counters, elapsed, sample.time)
+}
+
+// findProcessesByName returns the pids of the processes whose name (comm) or executable name is the given one
+func findProcessesByName(name string) ([]string, error) {
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []string{}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+
+		comm, err := ioutil.ReadFile(filepath.Join(procRoot, entry.Name(), "comm"))
+		if err != nil {
+			continue // The process exited
+		}
+		if strings.TrimSpace(string(comm)) == name {
+			pids = append(pids, entry.Name())
+			continue
+		}
+
+		// comm is truncated to 15 characters, the executable of the command line isn't
+		cmdline, err := ioutil.ReadFile(filepath.Join(procRoot, entry.Name(), "cmdline"))
+		if err == nil && len(cmdline) > 0 && filepath.Base(strings.SplitN(string(cmdline), "\x00", 2)[0]) == name {
+			pids = append(pids, entry.Name())
+		}
+	}
+
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process named %s", name)
+	}
+
+	return pids, nil
+}
+
+// readProcessesSample sums the stats of the processes. The network is the one of the namespace of the first process
+// still running, the processes exiting while they are read are skipped
+func readProcessesSample(pids []string) (*localSample, error) {
+	sample := &localSample{hasIO: true}
+	running := []string{}
+
+	for _, pid := range pids {
+		cpuSeconds, err := readProcessCPUSeconds(pid)
+		if processExited(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		status, err := readKeyValueFile(filepath.Join(procRoot, pid, "status"), ":")
+		if processExited(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		running = append(running, pid)
+		sample.cpuSeconds += cpuSeconds
+		sample.rssBytes += status["VmRSS"] * 1024 // in kB
+
+		io, err := readKeyValueFile(filepath.Join(procRoot, pid, "io"), ":")
+		if err != nil {
+			sample.hasIO = false
+		} else {
+			sample.readBytes += io["read_bytes"]
+			sample.writeBytes += io["write_bytes"]
+		}
+	}
+
+	if len(running) == 0 {
+		return nil, fmt.Errorf("the processes %s exited", strings.Join(pids, ", "))
+	}
+
+	sample.networkInBytes, sample.networkOutBytes, sample.hasNetwork = readProcessNetwork(running[0])
+
+	return sample, nil
+}
+
+// processExited tells whether a read in /proc/<pid> failed because the process exited
+func processExited(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ESRCH)
+}
+
+// readProcessCPUSeconds returns the user and system CPU time of a process, from /proc/<pid>/stat
+func readProcessCPUSeconds(pid string) (float64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(procRoot, pid, "stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	// The command name is between parentheses and can contain spaces, the fields are counted after it
+	stat := string(content)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected content in %s/%s/stat", procRoot, pid)
+	}
+
+	utime, err := strconv.ParseFloat(fields[11], 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseFloat(fields[12], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return (utime + stime) / procClockTicks, nil
+}
+
+// readProcessNetwork returns the bytes received and sent by the network namespace of a process, loopback excluded
+func readProcessNetwork(pid string) (float64, float64, bool) {
+	file, err := os.Open(filepath.Join(procRoot, pid, "net", "dev"))
+	if err != nil {
+		return 0, 0, false
+	}
+	defer file.Close()
+
+	var in, out float64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "lo" {
+			continue
+		}
+
+		// Interface: rx bytes, packets, errs, drop, fifo, frame, compressed, multicast, then the same for tx
+		fields := strings.Fields(parts[1])
+		if len(fields) < 9 {
+			continue
+		}
+		rx, rxErr := strconv.ParseFloat(fields[0], 64)
+		tx, txErr := strconv.ParseFloat(fields[8], 64)
+		if rxErr != nil || txErr != nil {
+			continue
+		}
+		in += rx
+		out += tx
+	}
+
+	return in, out, scanner.Err() == nil
+}
+
+// readContainerSample reads the cgroup v2 stats of a container. The network is the one of its first process
+func readContainerSample(containerID string) (*localSample, error) {
+	cgroupDir, err := findContainerCgroup(containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	cpuStat, err := readKeyValueFile(filepath.Join(cgroupDir, "cpu.stat"), " ")
+	if err != nil {
+		return nil, err
+	}
+	memoryStat, err := readKeyValueFile(filepath.Join(cgroupDir, "memory.stat"), " ")
+	if err != nil {
+		return nil, err
+	}
+
+	// The anonymous memory is the closest to the RSS of the processes
+	sample := &localSample{
+		cpuSeconds: cpuStat["usage_usec"] / 1e6,
+		rssBytes:   memoryStat["anon"],
+	}
+
+	sample.readBytes, sample.writeBytes, err = readCgroupIO(filepath.Join(cgroupDir, "io.stat"))
+	sample.hasIO = err == nil
+
+	procs, err := ioutil.ReadFile(filepath.Join(cgroupDir, "cgroup.procs"))
+	if err == nil && len(strings.Fields(string(procs))) > 0 {
+		sample.networkInBytes, sample.networkOutBytes, sample.hasNetwork = readProcessNetwork(strings.Fields(string(procs))[0])
+	}
+
+	return sample, nil
+}
+
+// findContainerCgroup returns the cgroup directory whose name contains the container id (eg: docker-<id>.scope)
+func findContainerCgroup(containerID string) (string, error) {
+	found := ""
+	errFound := fmt.Errorf("found")
+
+	err := filepath.Walk(cgroupRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if strings.Count(strings.TrimPrefix(path, cgroupRoot), string(os.PathSeparator)) > cgroupSearchDepth {
+			return filepath.SkipDir
+		}
+		if path != cgroupRoot && strings.Contains(info.Name(), containerID) {
+			found = path
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && err != errFound {
+		return "", err
+	}
+	if found == "" {
+		return "", fmt.Errorf("no cgroup found for the container %s under %s", containerID, cgroupRoot)
+	}
+
+	return found, nil
+}
+
+// readCgroupIO sums the bytes read and written on every device of a cgroup io.stat file
+func readCgroupIO(path string) (float64, float64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var read, written float64
+	for _, line := range strings.Split(string(content), "\n") {
+		// 8:0 rbytes=1459200 wbytes=314773504 rios=192 wios=353 dbytes=0 dios=0
+		for _, field := range strings.Fields(line) {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				continue
+			}
+			switch parts[0] {
+			case "rbytes":
+				read += value
+			case "wbytes":
+				written += value
+			}
+		}
+	}
+
+	return read, written, nil
+}
+
+// readKeyValueFile reads the numeric values of a "key<separator> value [unit]" file (eg: /proc/<pid>/status, cpu.stat)
+func readKeyValueFile(path string, separator string) (map[string]float64, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]float64{}
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, separator, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSpace(parts[0])] = value
+	}
+
+	return values, nil
+}
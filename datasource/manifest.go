@@ -0,0 +1,149 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	log "github.com/aleveille/tems/logger"
+)
+
+// The run manifest (config.RunManifestFile) describes a run: its configuration and the instances it ran against
+// It is written when the run starts and again when the instances change
+
+var (
+	manifestMutex     sync.Mutex
+	manifestStartTime time.Time
+)
+
+type runManifest struct {
+	SandboxID  string            `json:"sandboxId"`
+	TSDBSystem string            `json:"tsdbSystem"`
+	StartTime  time.Time         `json:"startTime"`
+	UpdateTime time.Time         `json:"updateTime"`
+	Config     map[string]string `json:"config"`
+
+	// eg: 6 × r5.2xlarge gp3, and its price per hour with config.CostModel
+	Summary    string         `json:"summary,omitempty"`
+	HourlyCost float64        `json:"hourlyCost,omitempty"`
+	ASGs       []manifestASG  `json:"asgs,omitempty"`
+	Nodes      []manifestNode `json:"nodes,omitempty"`
+	TagsNote   string         `json:"tagsNote,omitempty"`
+}
+
+// The Circonus metric tags are set when the check bundle is created, this manifest and the result log follow the instances
+const manifestTagsNote = "The check bundle metric tags are the instance metadata when the bundle was created, they aren't updated when the instances change. The current metadata is the one of this manifest and of the result log"
+
+type manifestASG struct {
+	Slot string   `json:"slot"`
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+type manifestNode struct {
+	Slot       string `json:"slot"`
+	InstanceID string `json:"instanceId"`
+	*instanceMetadata
+}
+
+// WriteRunManifest writes the run manifest, with the current instances of the sandbox
+func WriteRunManifest() {
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+
+	now := time.Now()
+	if manifestStartTime.IsZero() {
+		manifestStartTime = now
+	}
+
+	manifest := runManifest{
+		SandboxID:  config.SandboxID,
+		TSDBSystem: config.TSDBSystem,
+		StartTime:  manifestStartTime.UTC(),
+		UpdateTime: now.UTC(),
+		Config:     runConfigSummary(),
+	}
+	if config.InfraSource == "cloudwatch" {
+		AWSProxyInstance.addManifestInstances(&manifest)
+		manifest.TagsNote = manifestTagsNote
+	}
+	if config.CostModel {
+		hourly, missing := AWSProxyInstance.hourlyCost()
+		if len(missing) == 0 {
+			manifest.HourlyCost = hourly
+		}
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Errorf("Error while encoding the run manifest: %v", err)
+		return
+	}
+
+	err = ioutil.WriteFile(config.RunManifestFile, content, 0644)
+	if err != nil {
+		log.Warnf("Error while writing the run manifest %s: %v", config.RunManifestFile, err)
+	}
+}
+
+func (a *AWSProxy) addManifestInstances(manifest *runManifest) {
+	infraTags := a.InfraTags()
+
+	a.topology.mutex.RLock()
+	defer a.topology.mutex.RUnlock()
+
+	for asgSlot, asgName := range a.topology.asgNames {
+		if asgName != "" {
+			slot := fmt.Sprintf("tsdb-asg-%d", asgSlot+1)
+			manifest.ASGs = append(manifest.ASGs, manifestASG{Slot: slot, Name: asgName, Tags: infraTags["infra."+slot]})
+		}
+	}
+
+	// The nodes are counted by instance type and volume types for the summary
+	counts := map[string]int{}
+	for index, instanceID := range a.topology.instanceIDs {
+		if instanceID == "" {
+			continue
+		}
+
+		metadata, ok := a.topology.instances[instanceID]
+		if !ok {
+			metadata = &instanceMetadata{}
+		}
+		manifest.Nodes = append(manifest.Nodes, manifestNode{Slot: fmt.Sprintf("tsdb-node-%d", index+1), InstanceID: instanceID, instanceMetadata: metadata})
+
+		volumeTypes := map[string]bool{}
+		for _, volume := range metadata.Volumes {
+			if volume.VolumeType != "" {
+				volumeTypes[volume.VolumeType] = true
+			}
+		}
+		counts[strings.TrimSpace(metadata.InstanceType+" "+strings.Join(sortedKeys(volumeTypes), "+"))]++
+	}
+
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if counts[kinds[i]] != counts[kinds[j]] {
+			return counts[kinds[i]] > counts[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+
+	summaries := []string{}
+	for _, kind := range kinds {
+		name := kind
+		if name == "" {
+			name = "unknown"
+		}
+		summaries = append(summaries, fmt.Sprintf("%d × %s", counts[kind], name))
+	}
+	manifest.Summary = strings.Join(summaries, ", ")
+}
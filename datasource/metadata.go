@@ -0,0 +1,161 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/aleveille/tems/config"
+)
+
+// Metadata (discovery) queries are the ones Grafana sends to populate template variables: they don't return datapoints
+// but lists of tag keys, tag values or series. Their result value is the number of entries returned.
+
+var (
+	// IRONdb find API, eg: /find/1/tags?query=and(__name:randomint-1)
+	irondbFindPath = "/find/%s/%s?%s"
+)
+
+// IRONdbFindQuery will time a query to the IRONdb find API (tags, tag_cats or tag_vals) with the given tag query
+// The extraParams (eg: category=worker) are added to the query string as-is
+func (g *GrafanaProxy) IRONdbFindQuery(queryMetricName string, findType string, tagQuery string, extraParams url.Values) {
+	findPath := formatIRONdbFindPath(findType, tagQuery, extraParams)
+
+	timeQuery(queryMetricName,
+		func(queryTimestamp int64) (string, error) {
+			return g.doProxiedIRONdbFindHTTPQuery(findPath)
+		},
+		func(queryTimestamp int64) (string, error) {
+			return TSDBProxyInstance.doDirectIRONdbFindHTTPQuery(findPath)
+		})
+}
+
+func formatIRONdbFindPath(findType string, tagQuery string, extraParams url.Values) string {
+	params := url.Values{}
+	for key, values := range extraParams {
+		params[key] = values
+	}
+	params.Set("query", tagQuery)
+
+	return fmt.Sprintf(irondbFindPath, url.PathEscape(config.IRONdbAccountID), findType, params.Encode())
+}
+
+func (g *GrafanaProxy) doProxiedIRONdbFindHTTPQuery(findPath string) (string, error) {
+	req, _ := http.NewRequest("GET", datasourceProxyURL(g.queryDatasource)+findPath, nil)
+	req.Header.Add("x-circonus-account", config.IRONdbAccountID)
+
+	body, err := g.doProxiedHTTPRequest(req, "IRONdb find")
+	if err != nil {
+		return "nan", err
+	}
+
+	return parseIRONdbFindResponse(body)
+}
+
+func parseIRONdbFindResponse(body []byte) (string, error) {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return "nan", fmt.Errorf("unexpected IRONdb find response body: %s", err)
+	}
+
+	return strconv.Itoa(len(entries)), nil
+}
+
+// InfluxDBMetadataQuery will time an InfluxQL metadata query (SHOW TAG KEYS, SHOW TAG VALUES, SHOW SERIES, etc)
+func (g *GrafanaProxy) InfluxDBMetadataQuery(queryMetricName string, queryString string) {
+	timeQuery(queryMetricName,
+		func(queryTimestamp int64) (string, error) {
+			return g.doProxiedInfluxDBMetadataHTTPQuery(config.InfluxDBDatabaseName, queryString)
+		},
+		func(queryTimestamp int64) (string, error) {
+			return TSDBProxyInstance.doDirectInfluxDBMetadataHTTPQuery(config.InfluxDBDatabaseName, queryString)
+		})
+}
+
+func (g *GrafanaProxy) doProxiedInfluxDBMetadataHTTPQuery(db string, queryString string) (string, error) {
+	if config.GrafanaQueryAPI == "ds" {
+		startTimestamp, endTimestamp := dsQueryDefaultTimeRange()
+		return g.doDSMetadataQuery(g.influxQLDSQuery(queryString, "table"), startTimestamp, endTimestamp)
+	}
+
+	body, err := g.doProxiedInfluxDBHTTPRequest(db, queryString, config.InfluxDBEpoch)
+	if err != nil {
+		return "nan", err
+	}
+
+	return parseInfluxDBMetadataResponse(body)
+}
+
+func parseInfluxDBMetadataResponse(body []byte) (string, error) {
+	var response struct {
+		Results []struct {
+			Error  string `json:"error"`
+			Series []struct {
+				Values [][]interface{} `json:"values"`
+			} `json:"series"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "nan", fmt.Errorf("unexpected InfluxDB metadata response body: %s", err)
+	}
+
+	count := 0
+	for _, result := range response.Results {
+		if result.Error != "" {
+			return "nan", fmt.Errorf("InfluxDB metadata query error: %s", result.Error)
+		}
+		for _, series := range result.Series {
+			count += len(series.Values)
+		}
+	}
+
+	return strconv.Itoa(count), nil
+}
+
+// TimescaleDBMetadataQuery will time a Timescale query in table format (eg: SELECT DISTINCT) over the given range (in seconds)
+func (g *GrafanaProxy) TimescaleDBMetadataQuery(queryMetricName string, queryString string, queryRange int64) {
+	timeQuery(queryMetricName,
+		func(queryTimestamp int64) (string, error) {
+			return g.doProxiedTimescaleDBMetadataHTTPQuery(queryString, (queryTimestamp-queryRange)*1000, queryTimestamp*1000)
+		},
+		func(queryTimestamp int64) (string, error) {
+			return TSDBProxyInstance.doDirectTimescaleDBMetadataQuery(queryString, (queryTimestamp-queryRange)*1000, queryTimestamp*1000)
+		})
+}
+
+func (g *GrafanaProxy) doProxiedTimescaleDBMetadataHTTPQuery(queryString string, startTimestamp int64, endTimestamp int64) (string, error) {
+	if config.GrafanaQueryAPI == "ds" {
+		return g.doDSMetadataQuery(g.timescaleDSQuery(queryString, defaultIntervalMs, defaultMaxDataPoints, "table"), startTimestamp, endTimestamp)
+	}
+
+	body, err := g.doProxiedTimescaleDBHTTPRequest(queryString, startTimestamp, endTimestamp, defaultIntervalMs, defaultMaxDataPoints, "table")
+	if err != nil {
+		return "nan", err
+	}
+
+	var response struct {
+		Results map[string]struct {
+			Error  string `json:"error"`
+			Tables []struct {
+				Rows [][]interface{} `json:"rows"`
+			} `json:"tables"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "nan", fmt.Errorf("unexpected Timescale metadata response body: %s", err)
+	}
+
+	count := 0
+	for _, result := range response.Results {
+		if result.Error != "" {
+			return "nan", fmt.Errorf("Timescale metadata query error: %s", result.Error)
+		}
+		for _, table := range result.Tables {
+			count += len(table.Rows)
+		}
+	}
+
+	return strconv.Itoa(count), nil
+}
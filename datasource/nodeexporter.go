@@ -0,0 +1,239 @@
+package datasource
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/aleveille/tems/logger"
+)
+
+// The devices left out of the network and disk counters, as their traffic is already counted on the physical NICs and
+// disks (eg: the pod veths on top of eth0, the LVM and RAID devices on top of the disks). The same patterns are used
+// as PromQL regex matchers, see prometheusInfraQueries
+var (
+	virtualNetworkDevices = `lo|veth.*|cali.*|cni.*|docker.*|br-.*|flannel.*|cilium.*|vxlan.*|tunl.*|kube-.*|virbr.*`
+	virtualDiskDevices    = `dm-.*|md.*|loop.*|ram.*|zram.*`
+
+	virtualNetworkDeviceRegexp = regexp.MustCompile("^(?:" + virtualNetworkDevices + ")$")
+	virtualDiskDeviceRegexp    = regexp.MustCompile("^(?:" + virtualDiskDevices + ")$")
+)
+
+// nodeExporterSample is the node_exporter counters and gauges we need, summed across CPUs and devices
+type nodeExporterSample struct {
+	time time.Time
+
+	cpuIdleSeconds  float64
+	cpuTotalSeconds float64
+	networkInBytes  float64
+	networkOutBytes float64
+	diskReadBytes   float64
+	diskWriteBytes  float64
+
+	memoryTotalBytes     float64
+	memoryAvailableBytes float64
+}
+
+// scrapeNodeExporter scrapes a node_exporter endpoint and pushes the metrics of the node
+// The counters are turned into per-minute values between two scrapes (like the 1-minute CloudWatch sums), so they
+// are only pushed from the second scrape on
+func (i *InfraProxy) scrapeNodeExporter(nodeIndex int, metricsURL string) {
+	req, err := http.NewRequest("GET", metricsURL, nil)
+	if err != nil {
+		log.Errorf("Error creating the node_exporter request for %s:\n%s\n", metricsURL, err)
+		return
+	}
+	req.Header.Set("Accept", "text/plain")
+
+	body, err := i.doHTTPRequest(req, "node_exporter")
+	if err != nil {
+		log.Errorf("Error while scraping node_exporter on node %d:\n%s\n", nodeIndex+1, err)
+		return
+	}
+
+	sample, err := parseNodeExporterMetrics(body)
+	if err != nil {
+		log.Errorf("Error while parsing the node_exporter metrics of node %d:\n%s\n", nodeIndex+1, err)
+		return
+	}
+	sample.time = time.Now()
+
+	i.samplesMutex.Lock()
+	previous := i.samples[nodeIndex]
+	i.samples[nodeIndex] = sample
+	i.samplesMutex.Unlock()
+
+	if sample.memoryTotalBytes > 0 {
+		pushNodeResult(nodeIndex, "memory.utilization.avg", 100*(1-sample.memoryAvailableBytes/sample.memoryTotalBytes), sample.time)
+	}
+
+	if previous == nil {
+		return
+	}
+
+	elapsed := sample.time.Sub(previous.time).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	cpuTotal := sample.cpuTotalSeconds - previous.cpuTotalSeconds
+	if cpuTotal > 0 && sample.cpuIdleSeconds >= previous.cpuIdleSeconds {
+		pushNodeResult(nodeIndex, "cpu.utilization.avg", 100*(1-(sample.cpuIdleSeconds-previous.cpuIdleSeconds)/cpuTotal), sample.time)
+	}
+
+	pushNodeCounters(nodeIndex, []nodeCounter{
+		{"network.in.bytes", sample.networkInBytes, previous.networkInBytes},
+		{"network.out.bytes", sample.networkOutBytes, previous.networkOutBytes},
+		{"disk.read.bytes", sample.diskReadBytes, previous.diskReadBytes},
+		{"disk.write.bytes", sample.diskWriteBytes, previous.diskWriteBytes},
+	}, elapsed, sample.time)
+}
+
+// parseNodeExporterMetrics parses the Prometheus text format exposed by node_exporter
+// The loopback and virtual interfaces, and the device-mapper, RAID and loop devices are left out of the counters
+func parseNodeExporterMetrics(body []byte) (*nodeExporterSample, error) {
+	sample := &nodeExporterSample{}
+	found := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, labels, value, err := parsePrometheusTextLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+
+		switch name {
+		case "node_cpu_seconds_total":
+			sample.cpuTotalSeconds += value
+			if labels["mode"] == "idle" {
+				sample.cpuIdleSeconds += value
+			}
+		case "node_network_receive_bytes_total":
+			if !virtualNetworkDeviceRegexp.MatchString(labels["device"]) {
+				sample.networkInBytes += value
+			}
+		case "node_network_transmit_bytes_total":
+			if !virtualNetworkDeviceRegexp.MatchString(labels["device"]) {
+				sample.networkOutBytes += value
+			}
+		case "node_disk_read_bytes_total":
+			if !virtualDiskDeviceRegexp.MatchString(labels["device"]) {
+				sample.diskReadBytes += value
+			}
+		case "node_disk_written_bytes_total":
+			if !virtualDiskDeviceRegexp.MatchString(labels["device"]) {
+				sample.diskWriteBytes += value
+			}
+		case "node_memory_MemTotal_bytes":
+			sample.memoryTotalBytes = value
+		case "node_memory_MemAvailable_bytes":
+			sample.memoryAvailableBytes = value
+		default:
+			continue
+		}
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading the node_exporter metrics: %s", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("no node_exporter metric found in the response")
+	}
+
+	return sample, nil
+}
+
+// parsePrometheusTextLine parses a sample line of the Prometheus text format: name{label="value",...} value [timestamp]
+func parsePrometheusTextLine(line string) (string, map[string]string, float64, error) {
+	labels := map[string]string{}
+
+	nameEnd := strings.IndexAny(line, "{ \t")
+	if nameEnd < 0 {
+		return "", nil, 0, fmt.Errorf("invalid metric line %q", line)
+	}
+	name := line[:nameEnd]
+	rest := line[nameEnd:]
+
+	if strings.HasPrefix(rest, "{") {
+		labelsEnd := -1
+		inQuotes := false
+		for index := 1; index < len(rest); index++ {
+			switch {
+			case inQuotes && rest[index] == '\\':
+				index++
+			case rest[index] == '"':
+				inQuotes = !inQuotes
+			case !inQuotes && rest[index] == '}':
+				labelsEnd = index
+			}
+			if labelsEnd >= 0 {
+				break
+			}
+		}
+		if labelsEnd < 0 {
+			return "", nil, 0, fmt.Errorf("invalid labels in metric line %q", line)
+		}
+
+		for _, pair := range splitPrometheusLabels(rest[1:labelsEnd]) {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			labelValue, err := strconv.Unquote(strings.TrimSpace(parts[1]))
+			if err != nil {
+				labelValue = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+			}
+			labels[strings.TrimSpace(parts[0])] = labelValue
+		}
+		rest = rest[labelsEnd+1:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", nil, 0, fmt.Errorf("no value in metric line %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("invalid value in metric line %q: %s", line, err)
+	}
+
+	return name, labels, value, nil
+}
+
+// splitPrometheusLabels splits label pairs on the commas outside of the quoted values
+func splitPrometheusLabels(labels string) []string {
+	pairs := []string{}
+	start := 0
+	inQuotes := false
+	for index := 0; index < len(labels); index++ {
+		switch {
+		case inQuotes && labels[index] == '\\':
+			index++
+		case labels[index] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && labels[index] == ',':
+			pairs = append(pairs, labels[start:index])
+			start = index + 1
+		}
+	}
+	if strings.TrimSpace(labels[start:]) != "" {
+		pairs = append(pairs, labels[start:])
+	}
+
+	return pairs
+}
@@ -0,0 +1,130 @@
+package datasource
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParsePrometheusTextLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		name   string
+		labels map[string]string
+		value  float64
+		err    bool
+	}{
+		{
+			line:   `node_load1 0.42`,
+			name:   "node_load1",
+			labels: map[string]string{},
+			value:  0.42,
+		},
+		{
+			line:   `node_memory_MemTotal_bytes 1.6777216e+10 1590000000000`,
+			name:   "node_memory_MemTotal_bytes",
+			labels: map[string]string{},
+			value:  1.6777216e+10,
+		},
+		{
+			line:   `node_cpu_seconds_total{cpu="0",mode="idle"} 12345.67`,
+			name:   "node_cpu_seconds_total",
+			labels: map[string]string{"cpu": "0", "mode": "idle"},
+			value:  12345.67,
+		},
+		{
+			line:   `node_network_receive_bytes_total{device="eth0", } 42`,
+			name:   "node_network_receive_bytes_total",
+			labels: map[string]string{"device": "eth0"},
+			value:  42,
+		},
+		{
+			line:   `node_filesystem_avail_bytes{mountpoint="/data,logs",fstype="ext4"} 1024`,
+			name:   "node_filesystem_avail_bytes",
+			labels: map[string]string{"mountpoint": "/data,logs", "fstype": "ext4"},
+			value:  1024,
+		},
+		{
+			line:   `node_uname_info{version="#1 SMP {x} \"quoted\""} 1`,
+			name:   "node_uname_info",
+			labels: map[string]string{"version": `#1 SMP {x} "quoted"`},
+			value:  1,
+		},
+		{
+			line:   `node_scrape_collector_duration_seconds{collector="cpu"}	+Inf`,
+			name:   "node_scrape_collector_duration_seconds",
+			labels: map[string]string{"collector": "cpu"},
+			value:  math.Inf(1),
+		},
+		{line: `node_load1`, err: true},
+		{line: `node_load1{cpu="0" 1`, err: true},
+		{line: `node_load1{cpu="0"}`, err: true},
+		{line: `node_load1 high`, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			name, labels, value, err := parsePrometheusTextLine(test.line)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %s %v %v", name, labels, value)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if name != test.name {
+				t.Errorf("name = %q, want %q", name, test.name)
+			}
+			if !reflect.DeepEqual(labels, test.labels) {
+				t.Errorf("labels = %v, want %v", labels, test.labels)
+			}
+			if value != test.value {
+				t.Errorf("value = %v, want %v", value, test.value)
+			}
+		})
+	}
+}
+
+func TestParseNodeExporterMetricsDevices(t *testing.T) {
+	body := []byte(`# HELP node_network_receive_bytes_total Network device statistic receive_bytes.
+# TYPE node_network_receive_bytes_total counter
+node_network_receive_bytes_total{device="eth0"} 1000
+node_network_receive_bytes_total{device="lo"} 1
+node_network_receive_bytes_total{device="veth1a2b3c"} 10
+node_network_receive_bytes_total{device="cali0123456789"} 10
+node_network_receive_bytes_total{device="cni0"} 10
+node_network_receive_bytes_total{device="docker0"} 10
+node_network_receive_bytes_total{device="br-f00ba4"} 10
+node_network_transmit_bytes_total{device="ens5"} 2000
+node_network_transmit_bytes_total{device="flannel.1"} 20
+node_disk_read_bytes_total{device="nvme0n1"} 300
+node_disk_read_bytes_total{device="nvme1n1"} 400
+node_disk_read_bytes_total{device="dm-0"} 700
+node_disk_written_bytes_total{device="sda"} 500
+node_disk_written_bytes_total{device="md0"} 500
+node_disk_written_bytes_total{device="loop3"} 5
+`)
+
+	sample, err := parseNodeExporterMetrics(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		value float64
+		want  float64
+	}{
+		{"networkInBytes", sample.networkInBytes, 1000},
+		{"networkOutBytes", sample.networkOutBytes, 2000},
+		{"diskReadBytes", sample.diskReadBytes, 700},
+		{"diskWriteBytes", sample.diskWriteBytes, 500},
+	} {
+		if test.value != test.want {
+			t.Errorf("%s = %v, want %v", test.name, test.value, test.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package datasource
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/aleveille/tems/config"
+	appError "github.com/aleveille/tems/error"
+	log "github.com/aleveille/tems/logger"
+)
+
+// The bundled prices are the us-east-1 Linux on-demand ones, in USD. config.PriceTableFile overrides them (eg: for
+// another region, or a discount), with the same JSON format as priceTable
+
+var (
+	hoursPerMonth = 730.0
+
+	bundledPrices = priceTable{
+		Instances: map[string]float64{
+			"t3.medium": 0.0416, "t3.large": 0.0832, "t3.xlarge": 0.1664, "t3.2xlarge": 0.3328,
+			"m5.large": 0.096, "m5.xlarge": 0.192, "m5.2xlarge": 0.384, "m5.4xlarge": 0.768, "m5.8xlarge": 1.536,
+			"m6g.large": 0.077, "m6g.xlarge": 0.154, "m6g.2xlarge": 0.308, "m6g.4xlarge": 0.616,
+			"c5.large": 0.085, "c5.xlarge": 0.17, "c5.2xlarge": 0.34, "c5.4xlarge": 0.68, "c5.9xlarge": 1.53,
+			"r5.large": 0.126, "r5.xlarge": 0.252, "r5.2xlarge": 0.504, "r5.4xlarge": 1.008, "r5.8xlarge": 2.016,
+			"r5d.large": 0.144, "r5d.xlarge": 0.288, "r5d.2xlarge": 0.576, "r5d.4xlarge": 1.152,
+			"r6g.large": 0.1008, "r6g.xlarge": 0.2016, "r6g.2xlarge": 0.4032, "r6g.4xlarge": 0.8064,
+			"i3.large": 0.156, "i3.xlarge": 0.312, "i3.2xlarge": 0.624, "i3.4xlarge": 1.248, "i3.8xlarge": 2.496,
+			"i3en.large": 0.226, "i3en.xlarge": 0.452, "i3en.2xlarge": 0.904, "i3en.3xlarge": 1.356, "i3en.6xlarge": 2.712,
+		},
+		Volumes: map[string]volumePrice{
+			"gp2":      {GiBMonth: 0.10},
+			"gp3":      {GiBMonth: 0.08, IopsMonth: 0.005, FreeIops: 3000, ThroughputMonth: 0.04, FreeThroughputMBps: 125},
+			"io1":      {GiBMonth: 0.125, IopsMonth: 0.065},
+			"io2":      {GiBMonth: 0.125, IopsMonth: 0.065},
+			"st1":      {GiBMonth: 0.045},
+			"sc1":      {GiBMonth: 0.015},
+			"standard": {GiBMonth: 0.05},
+		},
+	}
+
+	// prices is the bundled prices with the overrides of config.PriceTableFile, see InitCostModel()
+	prices priceTable
+)
+
+// priceTable is the hourly price of the instance types and the monthly price of the EBS volume types
+type priceTable struct {
+	Instances map[string]float64     `json:"instances"`
+	Volumes   map[string]volumePrice `json:"volumes"`
+}
+
+// volumePrice is the monthly price of a volume type: per GiB, and per provisioned IOPS and MB/s above the ones
+// included with the volume
+type volumePrice struct {
+	GiBMonth           float64 `json:"gibMonth"`
+	IopsMonth          float64 `json:"iopsMonth"`
+	FreeIops           int64   `json:"freeIops"`
+	ThroughputMonth    float64 `json:"throughputMonth"`
+	FreeThroughputMBps int64   `json:"freeThroughputMBps"`
+}
+
+// InitCostModel loads the price table. The instance and volume types of config.PriceTableFile replace the bundled ones
+func InitCostModel() error {
+	log.Debug("InitCostModel() start")
+	defer log.Debug("InitCostModel() end")
+
+	prices = priceTable{Instances: map[string]float64{}, Volumes: map[string]volumePrice{}}
+	for instanceType, price := range bundledPrices.Instances {
+		prices.Instances[instanceType] = price
+	}
+	for volumeType, price := range bundledPrices.Volumes {
+		prices.Volumes[volumeType] = price
+	}
+
+	if config.PriceTableFile == "" {
+		if config.AWSRegion != "us-east-1" {
+			log.Warnf("The bundled prices are the us-east-1 ones, set priceTableFile for the %s prices", config.AWSRegion)
+		}
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(config.PriceTableFile)
+	if err != nil {
+		return appError.NewInitializationError("Error while reading the price table", err)
+	}
+
+	overrides := priceTable{}
+	err = json.Unmarshal(content, &overrides)
+	if err != nil {
+		return appError.NewInitializationError("Error while decoding the price table", err)
+	}
+
+	for instanceType, price := range overrides.Instances {
+		prices.Instances[instanceType] = price
+	}
+	for volumeType, price := range overrides.Volumes {
+		prices.Volumes[volumeType] = price
+	}
+
+	return nil
+}
+
+// hourlyPrice returns the hourly price of a volume
+func (p volumePrice) hourlyPrice(volume volumeMetadata) float64 {
+	monthly := p.GiBMonth * float64(volume.SizeGiB)
+	if volume.Iops > p.FreeIops {
+		monthly += p.IopsMonth * float64(volume.Iops-p.FreeIops)
+	}
+	if volume.ThroughputMBps > p.FreeThroughputMBps {
+		monthly += p.ThroughputMonth * float64(volume.ThroughputMBps-p.FreeThroughputMBps)
+	}
+
+	return monthly / hoursPerMonth
+}
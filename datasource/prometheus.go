@@ -0,0 +1,85 @@
+package datasource
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	prometheusQueryPath = "%s/api/v1/query?query=%s&time=%d"
+
+	// The PromQL queries of the infra metrics, aggregated by instance. %s is the series selector, see prometheusSelector()
+	// The bytes are per-minute values, like the 1-minute CloudWatch sums. The virtual devices are left out like in
+	// parseNodeExporterMetrics()
+	prometheusInfraQueries = []struct {
+		metricName string
+		query      string
+		matchers   string
+	}{
+		{"cpu.utilization.avg", `100 * (1 - avg by (instance) (rate(node_cpu_seconds_total{%s}[2m])))`, `mode="idle"`},
+		{"network.in.bytes", `sum by (instance) (rate(node_network_receive_bytes_total{%s}[2m])) * 60`, `device!~"` + virtualNetworkDevices + `"`},
+		{"network.out.bytes", `sum by (instance) (rate(node_network_transmit_bytes_total{%s}[2m])) * 60`, `device!~"` + virtualNetworkDevices + `"`},
+		{"disk.read.bytes", `sum by (instance) (rate(node_disk_read_bytes_total{%s}[2m])) * 60`, `device!~"` + virtualDiskDevices + `"`},
+		{"disk.write.bytes", `sum by (instance) (rate(node_disk_written_bytes_total{%s}[2m])) * 60`, `device!~"` + virtualDiskDevices + `"`},
+		{"memory.utilization.avg", `100 * (1 - sum by (instance) (node_memory_MemAvailable_bytes{%[1]s}) / sum by (instance) (node_memory_MemTotal_bytes{%[1]s}))`, ``},
+	}
+)
+
+// queryPrometheus runs the infra queries against Prometheus. The instance label of each series is mapped to its
+// node number through config.InfraNodeList, the other instances are ignored
+func (i *InfraProxy) queryPrometheus() {
+	nodeIndexes := map[string]int{}
+	for nodeIndex, instance := range config.InfraNodeList {
+		nodeIndexes[instance] = nodeIndex
+	}
+
+	now := time.Now()
+	for _, infraQuery := range prometheusInfraQueries {
+		query := fmt.Sprintf(infraQuery.query, prometheusSelector(infraQuery.matchers))
+		req, _ := http.NewRequest("GET", fmt.Sprintf(prometheusQueryPath, config.PrometheusURL, url.QueryEscape(query), now.Unix()), nil)
+
+		body, err := i.doHTTPRequest(req, "Prometheus")
+		if err != nil {
+			log.Errorf("Error while querying Prometheus for %s:\n%s\n", infraQuery.metricName, err)
+			continue
+		}
+
+		series, err := decodePrometheusVector(body)
+		if err != nil {
+			log.Errorf("Error while decoding the Prometheus %s response:\n%s\n", infraQuery.metricName, err)
+			continue
+		}
+
+		for _, s := range series {
+			nodeIndex, ok := nodeIndexes[s.Tags["instance"]]
+			if !ok {
+				log.Tracef("Ignoring the Prometheus instance %s, it isn't in infraNodes", s.Tags["instance"])
+				continue
+			}
+			if math.IsNaN(s.Last()) {
+				continue
+			}
+
+			pushNodeResult(nodeIndex, infraQuery.metricName, s.Last(), time.Unix(0, s.Timestamps[0]*int64(time.Millisecond)))
+		}
+	}
+}
+
+// prometheusSelector combines config.PrometheusSelector with the matchers specific to a query
+func prometheusSelector(matchers string) string {
+	selectors := []string{}
+	for _, selector := range []string{strings.TrimSpace(config.PrometheusSelector), matchers} {
+		if selector != "" {
+			selectors = append(selectors, selector)
+		}
+	}
+
+	return strings.Join(selectors, ",")
+}
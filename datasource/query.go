@@ -0,0 +1,137 @@
+package datasource
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/dataout"
+	log "github.com/aleveille/tems/logger"
+)
+
+// queryFunc runs a query for the given timestamp (the end of the query range) and returns its value
+type queryFunc func(queryTimestamp int64) (string, error)
+
+// timeQuery will time the query through Grafana and/or directly against the TSDB (depending on config.QueryMode)
+// and push the durations and values to the result channel. When running both, the difference between the two
+// durations is reported as the Grafana overhead. direct can be nil if the query has no direct equivalent.
+func timeQuery(queryMetricName string, viaGrafana queryFunc, direct queryFunc) {
+	queryTimestamp := time.Now().Unix()
+	atomic.AddInt64(&queriesRun, 1)
+
+	if config.QueryMode == "grafana" || direct == nil {
+		result, duration, ok := runTimedQuery(viaGrafana, queryTimestamp, "Grafana")
+		pushQueryResult(queryTimestamp, queryMetricName, "duration", formatDuration(duration, ok))
+		pushQueryResult(queryTimestamp, queryMetricName, "value", result)
+		trackQueryHealth(queryMetricName, ok)
+		return
+	}
+
+	if config.QueryMode == "direct" {
+		result, duration, ok := runTimedQuery(direct, queryTimestamp, "the TSDB")
+		pushQueryResult(queryTimestamp, queryMetricName, "direct-duration", formatDuration(duration, ok))
+		pushQueryResult(queryTimestamp, queryMetricName, "direct-value", result)
+		trackQueryHealth(queryMetricName, ok)
+		return
+	}
+
+	// Both paths run at the same time so they see the same load on the TSDB
+	var grafanaResult, directResult string
+	var grafanaDuration, directDuration time.Duration
+	var grafanaOk, directOk bool
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		grafanaResult, grafanaDuration, grafanaOk = runTimedQuery(viaGrafana, queryTimestamp, "Grafana")
+	}()
+	go func() {
+		defer wg.Done()
+		directResult, directDuration, directOk = runTimedQuery(direct, queryTimestamp, "the TSDB")
+	}()
+	wg.Wait()
+
+	pushQueryResult(queryTimestamp, queryMetricName, "duration", formatDuration(grafanaDuration, grafanaOk))
+	pushQueryResult(queryTimestamp, queryMetricName, "value", grafanaResult)
+	pushQueryResult(queryTimestamp, queryMetricName, "direct-duration", formatDuration(directDuration, directOk))
+	pushQueryResult(queryTimestamp, queryMetricName, "direct-value", directResult)
+	if grafanaOk && directOk {
+		pushQueryResult(queryTimestamp, queryMetricName, "overhead-duration", formatDuration(grafanaDuration-directDuration, true))
+	}
+	trackQueryHealth(queryMetricName, grafanaOk && directOk)
+}
+
+// runTimedQuery returns the query value, its duration and whether it succeeded. On error, the value is "nan"
+func runTimedQuery(query queryFunc, queryTimestamp int64, target string) (string, time.Duration, bool) {
+	queryStartTime := time.Now()
+
+	result, err := query(queryTimestamp)
+	if err != nil {
+		log.Errorf("Error while querying %s:\n%v\n", target, err)
+		return "nan", 0, false
+	}
+
+	return result, time.Since(queryStartTime), true
+}
+
+// formatDuration formats a duration in milliseconds, or "nan" if the query failed
+func formatDuration(duration time.Duration, ok bool) string {
+	if !ok {
+		return "nan"
+	}
+
+	return fmt.Sprintf("%.2f", float64(duration.Nanoseconds())/1000/1000)
+}
+
+func pushQueryResult(queryTimestamp int64, queryMetricName string, suffix string, value string) {
+	select {
+	case dataout.ResultChan <- dataout.Result{Timestamp: queryTimestamp, Name: fmt.Sprintf("%s.query.%s.%s", config.SandboxID, queryMetricName, suffix), Value: value}:
+	default:
+		log.Error("Channel full, discarding result")
+	}
+}
+
+// parseCAQLResponse returns the last datapoint of the first series of a CAQL DF4 response
+func parseCAQLResponse(body []byte) (string, error) {
+	series, err := decodeCAQLDF4(body)
+	if err != nil {
+		return "nan", err
+	}
+
+	return lastSeriesValue(series), nil
+}
+
+// parseInfluxDBResponse returns the last datapoint of the first series of an InfluxQL JSON response
+func parseInfluxDBResponse(body []byte, queryString string) (string, error) {
+	series, err := decodeInfluxQL(body)
+	if err != nil {
+		return "nan", err
+	}
+	if len(series) == 0 {
+		log.Debugf("InfluxDB: no series returned by the query %s", queryString)
+	}
+
+	return lastSeriesValue(series), nil
+}
+
+// parseFluxResponse returns the last value of the first table of a Flux annotated CSV response
+func parseFluxResponse(body []byte) (string, error) {
+	series, err := decodeFluxCSV(body)
+	if err != nil {
+		return "nan", err
+	}
+
+	return lastSeriesValue(series), nil
+}
+
+// parseTimescaleResponse returns the last datapoint of the first series of a Grafana tsdb API time series response
+func parseTimescaleResponse(body []byte) (string, error) {
+	series, err := decodeGrafanaTimeSeries(body)
+	if err != nil {
+		return "nan", err
+	}
+
+	return lastSeriesValue(series), nil
+}
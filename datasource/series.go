@@ -0,0 +1,400 @@
+package datasource
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Series is a time series decoded from a TSDB or Grafana response, whatever the wire format
+// Null or non-numeric values are decoded as NaN
+type Series struct {
+	Name       string
+	Tags       map[string]string
+	Timestamps []int64 // ms since epoch
+	Values     []float64
+}
+
+// Last returns the last value of the series, or NaN if it is empty
+func (s Series) Last() float64 {
+	if len(s.Values) == 0 {
+		return math.NaN()
+	}
+
+	return s.Values[len(s.Values)-1]
+}
+
+// lastSeriesValue returns the last value of the first series, formatted for the result channel ("nan" if there's none)
+func lastSeriesValue(series []Series) string {
+	if len(series) == 0 {
+		return "nan"
+	}
+
+	return formatFloat(series[0].Last())
+}
+
+func formatFloat(value float64) string {
+	if math.IsNaN(value) {
+		return "nan"
+	}
+
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// toFloat converts a decoded JSON value to a float64, the TSDBs send numbers, strings (eg: numeric columns) or null
+func toFloat(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	default:
+		return math.NaN()
+	}
+}
+
+// toTimestamp converts a decoded JSON time to ms since epoch. It is either a number (already in ms) or an RFC3339 string
+func toTimestamp(value interface{}) int64 {
+	switch v := value.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0
+		}
+		return t.UnixNano() / int64(time.Millisecond)
+	default:
+		return 0
+	}
+}
+
+// decodeCAQLDF4 decodes a CAQL response in the DF4 format, see https://docs.circonus.com/caql/
+// The datapoints of all the series share the head start/period
+func decodeCAQLDF4(body []byte) ([]Series, error) {
+	var response struct {
+		Version string `json:"version"`
+		Head    struct {
+			Count  int   `json:"count"`
+			Start  int64 `json:"start"`
+			Period int64 `json:"period"`
+		} `json:"head"`
+		Meta []struct {
+			Label string   `json:"label"`
+			Tags  []string `json:"tags"`
+		} `json:"meta"`
+		Data [][]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("unexpected CAQL response body: %s", err)
+	}
+	if response.Version != "DF4" {
+		return nil, fmt.Errorf("unexpected CAQL response version: %q", response.Version)
+	}
+
+	series := make([]Series, len(response.Data))
+	for i, datapoints := range response.Data {
+		if i < len(response.Meta) {
+			series[i].Name = response.Meta[i].Label
+			series[i].Tags = parseCirconusTags(response.Meta[i].Tags)
+		}
+		series[i].Timestamps = make([]int64, len(datapoints))
+		series[i].Values = make([]float64, len(datapoints))
+		for j, value := range datapoints {
+			series[i].Timestamps[j] = (response.Head.Start + int64(j)*response.Head.Period) * 1000
+			series[i].Values[j] = toFloat(value)
+		}
+	}
+
+	return series, nil
+}
+
+// parseCirconusTags converts category:value tags to a map. Tags without a value are kept with an empty value
+func parseCirconusTags(tags []string) map[string]string {
+	parsed := map[string]string{}
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) == 2 {
+			parsed[parts[0]] = parts[1]
+		} else {
+			parsed[parts[0]] = ""
+		}
+	}
+
+	return parsed
+}
+
+// decodeInfluxQL decodes an InfluxQL JSON response. Every column after the time is decoded as its own series
+func decodeInfluxQL(body []byte) ([]Series, error) {
+	var response struct {
+		Error   string `json:"error"`
+		Results []struct {
+			Error  string `json:"error"`
+			Series []struct {
+				Name    string            `json:"name"`
+				Tags    map[string]string `json:"tags"`
+				Columns []string          `json:"columns"`
+				Values  [][]interface{}   `json:"values"`
+			} `json:"series"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("unexpected InfluxDB response body: %s", err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("InfluxDB query error: %s", response.Error)
+	}
+
+	series := []Series{}
+	for _, result := range response.Results {
+		if result.Error != "" {
+			return nil, fmt.Errorf("InfluxDB query error: %s", result.Error)
+		}
+
+		for _, influxSeries := range result.Series {
+			for column := 1; column < len(influxSeries.Columns); column++ {
+				s := Series{Name: influxSeries.Name + "." + influxSeries.Columns[column], Tags: influxSeries.Tags}
+				for _, row := range influxSeries.Values {
+					if len(row) <= column {
+						continue
+					}
+					s.Timestamps = append(s.Timestamps, toTimestamp(row[0]))
+					s.Values = append(s.Values, toFloat(row[column]))
+				}
+				series = append(series, s)
+			}
+		}
+	}
+
+	return series, nil
+}
+
+// decodeFluxCSV decodes a Flux annotated CSV response. There is one series per table of each result (the "result" and
+// "table" columns, the table numbering restarts in every result of a query with several yield())
+// The series name is built from the _measurement and _field columns, the other non-underscore columns are the tags
+func decodeFluxCSV(body []byte) ([]Series, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+
+	type tableKey struct {
+		result string
+		table  string
+	}
+	tables := map[tableKey]*Series{}
+	resultOrder := map[string]int{}
+	var header, defaults []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unexpected Flux response body: %s", err)
+		}
+
+		// Annotations (#datatype, #group, #default) come before the header of each table. With annotations, the
+		// result name is usually only in #default
+		if len(record) == 0 || strings.HasPrefix(record[0], "#") {
+			if len(record) > 0 && record[0] == "#default" {
+				defaults = record
+			}
+			header = nil
+			continue
+		}
+		// The csv reader skips the empty lines between tables, so a new header is recognized by its content
+		if header == nil || (len(record) > 2 && record[1] == "result" && record[2] == "table") || (len(record) > 1 && record[1] == "error") {
+			header = record
+			continue
+		}
+		// Errors are returned as a table with an error column
+		if len(header) > 1 && header[1] == "error" {
+			return nil, fmt.Errorf("Flux query error: %s", strings.Join(record, ","))
+		}
+
+		row := map[string]string{}
+		for i, column := range header {
+			if i < len(record) {
+				row[column] = record[i]
+			}
+			if row[column] == "" && i < len(defaults) {
+				row[column] = defaults[i]
+			}
+		}
+
+		key := tableKey{result: row["result"], table: row["table"]}
+		if _, ok := resultOrder[key.result]; !ok {
+			resultOrder[key.result] = len(resultOrder)
+		}
+		s, ok := tables[key]
+		if !ok {
+			s = &Series{Name: row["_measurement"] + "." + row["_field"], Tags: map[string]string{}}
+			for column, value := range row {
+				if column != "" && column != "result" && column != "table" && !strings.HasPrefix(column, "_") {
+					s.Tags[column] = value
+				}
+			}
+			tables[key] = s
+		}
+		s.Timestamps = append(s.Timestamps, toTimestamp(row["_time"]))
+		s.Values = append(s.Values, toFloat(row["_value"]))
+	}
+
+	// Keep the results in their order, and their tables in their numeric order
+	keys := make([]tableKey, 0, len(tables))
+	for key := range tables {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].result != keys[j].result {
+			return resultOrder[keys[i].result] < resultOrder[keys[j].result]
+		}
+		a, _ := strconv.Atoi(keys[i].table)
+		b, _ := strconv.Atoi(keys[j].table)
+		return a < b
+	})
+
+	series := make([]Series, 0, len(tables))
+	for _, key := range keys {
+		series = append(series, *tables[key])
+	}
+
+	return series, nil
+}
+
+// decodeGrafanaTimeSeries decodes a legacy Grafana /api/tsdb/query response in the time_series format
+// The points are [value, timestamp] pairs
+func decodeGrafanaTimeSeries(body []byte) ([]Series, error) {
+	var response struct {
+		Message string `json:"message"`
+		Results map[string]struct {
+			Error  string `json:"error"`
+			Series []struct {
+				Name   string            `json:"name"`
+				Tags   map[string]string `json:"tags"`
+				Points [][]interface{}   `json:"points"`
+			} `json:"series"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("unexpected Grafana time series response body: %s", err)
+	}
+
+	// The results are keyed by refId, sort them so the series order is stable
+	refIDs := make([]string, 0, len(response.Results))
+	for refID := range response.Results {
+		refIDs = append(refIDs, refID)
+	}
+	sort.Strings(refIDs)
+
+	series := []Series{}
+	for _, refID := range refIDs {
+		result := response.Results[refID]
+		if result.Error != "" {
+			return nil, fmt.Errorf("Grafana query error: %s", result.Error)
+		}
+
+		for _, grafanaSeries := range result.Series {
+			s := Series{Name: grafanaSeries.Name, Tags: grafanaSeries.Tags}
+			for _, point := range grafanaSeries.Points {
+				if len(point) < 2 {
+					continue
+				}
+				s.Values = append(s.Values, toFloat(point[0]))
+				s.Timestamps = append(s.Timestamps, toTimestamp(point[1]))
+			}
+			series = append(series, s)
+		}
+	}
+
+	return series, nil
+}
+
+// decodeDataFrames converts Grafana data frames to series. Every numeric field of a frame is its own series,
+// using the first time field of the frame for the timestamps
+func decodeDataFrames(frames []dataFrame) []Series {
+	series := []Series{}
+
+	for _, frame := range frames {
+		timeIndex := -1
+		for i, field := range frame.Schema.Fields {
+			if field.Type == "time" {
+				timeIndex = i
+				break
+			}
+		}
+
+		for i, field := range frame.Schema.Fields {
+			if field.Type != "number" || i >= len(frame.Data.Values) {
+				continue
+			}
+
+			name := field.Name
+			if frame.Schema.Name != "" {
+				name = frame.Schema.Name + "." + field.Name
+			}
+			s := Series{Name: name, Tags: field.Labels}
+			for j, value := range frame.Data.Values[i] {
+				if timeIndex >= 0 && timeIndex < len(frame.Data.Values) && j < len(frame.Data.Values[timeIndex]) {
+					s.Timestamps = append(s.Timestamps, toTimestamp(frame.Data.Values[timeIndex][j]))
+				} else {
+					s.Timestamps = append(s.Timestamps, 0)
+				}
+				s.Values = append(s.Values, toFloat(value))
+			}
+			series = append(series, s)
+		}
+	}
+
+	return series
+}
+
+// decodePrometheusVector decodes a Prometheus /api/v1/query response of the vector type. There is one series per
+// element, with a single point. The labels are the tags and the __name__ label, when there's one, the name
+func decodePrometheusVector(body []byte) ([]Series, error) {
+	var response struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []interface{}     `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("unexpected Prometheus response body: %s", err)
+	}
+	if response.Status != "success" {
+		return nil, fmt.Errorf("Prometheus query error: %s", response.Error)
+	}
+	if response.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("unexpected Prometheus result type: %q", response.Data.ResultType)
+	}
+
+	series := make([]Series, 0, len(response.Data.Result))
+	for _, result := range response.Data.Result {
+		if len(result.Value) < 2 {
+			continue
+		}
+
+		// The timestamp is in seconds, with a fractional part
+		s := Series{Name: result.Metric["__name__"], Tags: result.Metric}
+		s.Timestamps = []int64{int64(math.Round(toFloat(result.Value[0]) * 1000))}
+		s.Values = []float64{toFloat(result.Value[1])}
+		series = append(series, s)
+	}
+
+	return series, nil
+}
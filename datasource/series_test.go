@@ -0,0 +1,259 @@
+package datasource
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// nan stands for a null or non-numeric value in the expected series
+var nan = math.NaN()
+
+// equalSeries compares the series, NaN values being equal
+func equalSeries(got []Series, want []Series) bool {
+	if len(got) != len(want) {
+		return false
+	}
+
+	for i := range got {
+		if got[i].Name != want[i].Name || !reflect.DeepEqual(got[i].Timestamps, want[i].Timestamps) || len(got[i].Values) != len(want[i].Values) {
+			return false
+		}
+		if (len(got[i].Tags) > 0 || len(want[i].Tags) > 0) && !reflect.DeepEqual(got[i].Tags, want[i].Tags) {
+			return false
+		}
+		for j := range got[i].Values {
+			if got[i].Values[j] != want[i].Values[j] && !(math.IsNaN(got[i].Values[j]) && math.IsNaN(want[i].Values[j])) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func TestDecoders(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func([]byte) ([]Series, error)
+		body   string
+		series []Series
+		err    string
+	}{
+		{
+			name:   "CAQL DF4 with nulls",
+			decode: decodeCAQLDF4,
+			body: `{"version":"DF4","head":{"count":3,"start":1590000000,"period":60},
+				"meta":[{"kind":"numeric","label":"lagrande.latency","tags":["__check_uuid:abc","node:lg1","beta"]},{"kind":"numeric","label":"other"}],
+				"data":[[1.5,null,2.5],[null,null,null]]}`,
+			series: []Series{
+				{Name: "lagrande.latency", Tags: map[string]string{"__check_uuid": "abc", "node": "lg1", "beta": ""}, Timestamps: []int64{1590000000000, 1590000060000, 1590000120000}, Values: []float64{1.5, nan, 2.5}},
+				{Name: "other", Timestamps: []int64{1590000000000, 1590000060000, 1590000120000}, Values: []float64{nan, nan, nan}},
+			},
+		},
+		{
+			name:   "CAQL DF4 without data",
+			decode: decodeCAQLDF4,
+			body:   `{"version":"DF4","head":{"count":0,"start":1590000000,"period":60},"meta":[],"data":[]}`,
+			series: []Series{},
+		},
+		{
+			name:   "CAQL other version",
+			decode: decodeCAQLDF4,
+			body:   `{"version":"DF3","data":[]}`,
+			err:    "unexpected CAQL response version",
+		},
+		{
+			name:   "InfluxQL",
+			decode: decodeInfluxQL,
+			body: `{"results":[{"statement_id":0,"series":[
+				{"name":"1m.randomint-1","tags":{"worker":"101"},"columns":["time","mean","max"],"values":[[1590000000000,1.5,3],[1590000060000,null,4]]},
+				{"name":"1m.randomint-1","tags":{"worker":"102"},"columns":["time","mean"],"values":[["2020-05-20T18:40:00Z",2]]}]}]}`,
+			series: []Series{
+				{Name: "1m.randomint-1.mean", Tags: map[string]string{"worker": "101"}, Timestamps: []int64{1590000000000, 1590000060000}, Values: []float64{1.5, nan}},
+				{Name: "1m.randomint-1.max", Tags: map[string]string{"worker": "101"}, Timestamps: []int64{1590000000000, 1590000060000}, Values: []float64{3, 4}},
+				{Name: "1m.randomint-1.mean", Tags: map[string]string{"worker": "102"}, Timestamps: []int64{1590000000000}, Values: []float64{2}},
+			},
+		},
+		{
+			name:   "InfluxQL statement without series",
+			decode: decodeInfluxQL,
+			body:   `{"results":[{"statement_id":0}]}`,
+			series: []Series{},
+		},
+		{
+			name:   "InfluxQL per-statement error",
+			decode: decodeInfluxQL,
+			body: `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","mean"],"values":[[1590000000000,1]]}]},
+				{"statement_id":1,"error":"database not found: nodb"}]}`,
+			err: "database not found: nodb",
+		},
+		{
+			name:   "InfluxQL request error",
+			decode: decodeInfluxQL,
+			body:   `{"error":"error parsing query: found EOF, expected FROM at line 1, char 14"}`,
+			err:    "error parsing query",
+		},
+		{
+			name:   "Flux annotated CSV with several results and tables",
+			decode: decodeFluxCSV,
+			body: "#group,false,false,true,true,false,false,true,true,true\r\n" +
+				"#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string\r\n" +
+				"#default,mean,,,,,,,,\r\n" +
+				",result,table,_start,_stop,_time,_value,_field,_measurement,worker\r\n" +
+				",,0,2020-05-20T00:00:00Z,2020-05-21T00:00:00Z,2020-05-20T18:40:00Z,1.5,value,randomint-1,101\r\n" +
+				",,0,2020-05-20T00:00:00Z,2020-05-21T00:00:00Z,2020-05-20T18:41:00Z,,value,randomint-1,101\r\n" +
+				",,1,2020-05-20T00:00:00Z,2020-05-21T00:00:00Z,2020-05-20T18:40:00Z,3.5,value,randomint-1,102\r\n" +
+				"\r\n" +
+				"#group,false,false,true,true,false,false,true,true,true\r\n" +
+				"#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string\r\n" +
+				"#default,max,,,,,,,,\r\n" +
+				",result,table,_start,_stop,_time,_value,_field,_measurement,worker\r\n" +
+				",,0,2020-05-20T00:00:00Z,2020-05-21T00:00:00Z,2020-05-20T18:40:00Z,9,value,randomint-1,101\r\n" +
+				"\r\n",
+			series: []Series{
+				{Name: "randomint-1.value", Tags: map[string]string{"worker": "101"}, Timestamps: []int64{1590000000000, 1590000060000}, Values: []float64{1.5, nan}},
+				{Name: "randomint-1.value", Tags: map[string]string{"worker": "102"}, Timestamps: []int64{1590000000000}, Values: []float64{3.5}},
+				{Name: "randomint-1.value", Tags: map[string]string{"worker": "101"}, Timestamps: []int64{1590000000000}, Values: []float64{9}},
+			},
+		},
+		{
+			name:   "Flux CSV without annotations",
+			decode: decodeFluxCSV,
+			body: ",result,table,_time,_value,_field,_measurement\r\n" +
+				",_result,0,2020-05-20T18:40:00Z,1,value,cpu\r\n" +
+				",_result,1,2020-05-20T18:40:00Z,2,value,mem\r\n" +
+				",other,0,2020-05-20T18:40:00Z,3,value,disk\r\n",
+			series: []Series{
+				{Name: "cpu.value", Timestamps: []int64{1590000000000}, Values: []float64{1}},
+				{Name: "mem.value", Timestamps: []int64{1590000000000}, Values: []float64{2}},
+				{Name: "disk.value", Timestamps: []int64{1590000000000}, Values: []float64{3}},
+			},
+		},
+		{
+			name:   "Flux CSV with an error table",
+			decode: decodeFluxCSV,
+			body: "#group,false,false,false,false\r\n" +
+				"#datatype,string,long,dateTime:RFC3339,double\r\n" +
+				"#default,_result,,,\r\n" +
+				",result,table,_time,_value\r\n" +
+				",,0,2020-05-20T18:40:00Z,1\r\n" +
+				"\r\n" +
+				"#datatype,string,string\r\n" +
+				"#group,true,true\r\n" +
+				"#default,,\r\n" +
+				",error,reference\r\n" +
+				",\"failed to execute query: bucket \"\"nodb\"\" not found\",897\r\n",
+			err: `bucket "nodb" not found`,
+		},
+		{
+			name:   "Grafana time series",
+			decode: decodeGrafanaTimeSeries,
+			body: `{"results":{
+				"B":{"refId":"B","series":[{"name":"b","points":[[2,1590000060000]]}]},
+				"A":{"refId":"A","series":[{"name":"a","tags":{"worker":"1"},"points":[[1,1590000000000],[null,1590000060000],[5]]}]}}}`,
+			series: []Series{
+				{Name: "a", Tags: map[string]string{"worker": "1"}, Timestamps: []int64{1590000000000, 1590000060000}, Values: []float64{1, nan}},
+				{Name: "b", Timestamps: []int64{1590000060000}, Values: []float64{2}},
+			},
+		},
+		{
+			name:   "Grafana time series error",
+			decode: decodeGrafanaTimeSeries,
+			body:   `{"results":{"A":{"refId":"A","error":"pq: relation \"randomint1\" does not exist"}}}`,
+			err:    `relation "randomint1" does not exist`,
+		},
+		{
+			name:   "Prometheus vector",
+			decode: decodePrometheusVector,
+			body: `{"status":"success","data":{"resultType":"vector","result":[
+				{"metric":{"instance":"node1:9100"},"value":[1590000000.123,"42.5"]},
+				{"metric":{"__name__":"up","instance":"node2:9100"},"value":[1590000000.123,"NaN"]},
+				{"metric":{},"value":[]}]}}`,
+			series: []Series{
+				{Name: "", Tags: map[string]string{"instance": "node1:9100"}, Timestamps: []int64{1590000000123}, Values: []float64{42.5}},
+				{Name: "up", Tags: map[string]string{"__name__": "up", "instance": "node2:9100"}, Timestamps: []int64{1590000000123}, Values: []float64{nan}},
+			},
+		},
+		{
+			name:   "Prometheus error",
+			decode: decodePrometheusVector,
+			body:   `{"status":"error","errorType":"bad_data","error":"parse error at char 5"}`,
+			err:    "parse error at char 5",
+		},
+		{
+			name:   "Prometheus matrix",
+			decode: decodePrometheusVector,
+			body:   `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+			err:    "unexpected Prometheus result type",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			series, err := test.decode([]byte(test.body))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !equalSeries(series, test.series) {
+				t.Errorf("series = %+v, want %+v", series, test.series)
+			}
+		})
+	}
+}
+
+func TestDecodeDataFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		series []Series
+	}{
+		{
+			name: "time series with nulls",
+			body: `[{"schema":{"name":"randomint1","fields":[{"name":"time","type":"time"},{"name":"value","type":"number","labels":{"worker":"1"}}]},
+				"data":{"values":[[1590000000000,1590000060000],[1.5,null]]}}]`,
+			series: []Series{
+				{Name: "randomint1.value", Tags: map[string]string{"worker": "1"}, Timestamps: []int64{1590000000000, 1590000060000}, Values: []float64{1.5, nan}},
+			},
+		},
+		{
+			name: "table without a time field",
+			body: `[{"schema":{"fields":[{"name":"metric","type":"string"},{"name":"count","type":"number"}]},
+				"data":{"values":[["a","b"],[3,4]]}}]`,
+			series: []Series{
+				{Name: "count", Timestamps: []int64{0, 0}, Values: []float64{3, 4}},
+			},
+		},
+		{
+			name: "several frames, the time field last",
+			body: `[{"schema":{"fields":[{"name":"A-series","type":"number"},{"name":"Time","type":"time"}]},"data":{"values":[[7],[1590000000000]]}},
+				{"schema":{"fields":[{"name":"value","type":"number"}]},"data":{"values":[]}}]`,
+			series: []Series{
+				{Name: "A-series", Timestamps: []int64{1590000000000}, Values: []float64{7}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var frames []dataFrame
+			if err := json.Unmarshal([]byte(test.body), &frames); err != nil {
+				t.Fatalf("invalid test frames: %s", err)
+			}
+
+			series := decodeDataFrames(frames)
+			if !equalSeries(series, test.series) {
+				t.Errorf("series = %+v, want %+v", series, test.series)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package datasource
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/dataout"
+	appError "github.com/aleveille/tems/error"
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	// GrafanaMetrics are the metric names (relative to the sandbox ID) reported about the Grafana session
+	GrafanaMetrics = []string{"grafana.auth.refresh.count"}
+
+	cookieRegexp = regexp.MustCompile("(grafana_session=[^;]*).*Max-Age=([0-9]*)")
+
+	// Delay before retrying a failed session renewal
+	sessionRenewalRetryDelay = 5 * time.Second
+)
+
+// grafanaSession is the Grafana session cookie (password auth mode). The queries read it concurrently
+// while it gets renewed on expiry or on a 401/403, so every access goes through the mutex.
+// The generation is incremented on every login so concurrent 401/403s only trigger a single renewal.
+// The login itself runs outside of the lock, so the queries aren't held up while it is renewed.
+type grafanaSession struct {
+	mutex        sync.RWMutex
+	cookie       string
+	generation   int
+	refreshCount int
+
+	// renewing is set while a renewal logs in, the concurrent renewals wait for renewed to be closed
+	renewing bool
+	renewed  chan struct{}
+
+	// renewErr is the error of the failed renewal, returned to the renewals of the same generation until
+	// retryTimer logs in again. There is a single retry timer at a time
+	renewErr   error
+	retryTimer *time.Timer
+
+	// forbiddenGeneration is the generation in which a request still got a 403 after the session renewal: the 403s are
+	// then missing permissions, they don't renew that session again
+	forbiddenGeneration int
+}
+
+func (g *GrafanaProxy) sessionCookie() string {
+	g.session.mutex.RLock()
+	defer g.session.mutex.RUnlock()
+
+	return g.session.cookie
+}
+
+func (g *GrafanaProxy) sessionGeneration() int {
+	g.session.mutex.RLock()
+	defer g.session.mutex.RUnlock()
+
+	return g.session.generation
+}
+
+// forbiddenAfterRenewal returns whether a 403 already outlived a renewal in the given generation
+func (g *GrafanaProxy) forbiddenAfterRenewal(generation int) bool {
+	g.session.mutex.RLock()
+	defer g.session.mutex.RUnlock()
+
+	return g.session.forbiddenGeneration == generation
+}
+
+func (g *GrafanaProxy) setForbiddenAfterRenewal(generation int) {
+	g.session.mutex.Lock()
+	defer g.session.mutex.Unlock()
+
+	g.session.forbiddenGeneration = generation
+}
+
+// startSession logs in to Grafana, the session then renews itself before it expires
+func (g *GrafanaProxy) startSession() error {
+	cookie, maxAge, err := g.login()
+	if err != nil {
+		return err
+	}
+
+	g.session.mutex.Lock()
+	defer g.session.mutex.Unlock()
+
+	g.setSession(cookie, maxAge)
+	return nil
+}
+
+// renewSession logs in again, unless the session was already renewed since the given generation
+// On failure, a single renewal is scheduled so a transient Grafana error doesn't leave us without a session. Until
+// then, the renewals of the same generation return the error without logging in
+func (g *GrafanaProxy) renewSession(generation int) error {
+	g.session.mutex.Lock()
+	if generation != g.session.generation {
+		g.session.mutex.Unlock()
+		return nil
+	}
+	if g.session.renewErr != nil {
+		err := g.session.renewErr
+		g.session.mutex.Unlock()
+		return err
+	}
+	if g.session.renewing {
+		renewed := g.session.renewed
+		g.session.mutex.Unlock()
+
+		<-renewed
+		return g.renewalResult(generation)
+	}
+	g.session.renewing = true
+	g.session.renewed = make(chan struct{})
+	g.session.mutex.Unlock()
+
+	cookie, maxAge, err := g.login()
+
+	g.session.mutex.Lock()
+	defer g.session.mutex.Unlock()
+	defer close(g.session.renewed)
+	g.session.renewing = false
+
+	if err != nil {
+		g.session.renewErr = err
+		if g.session.retryTimer == nil {
+			log.Errorf("Grafana: error while renewing the session, retrying in %s:\n%v\n", sessionRenewalRetryDelay, err)
+			// Annotate() is asynchronous, so it doesn't wait on the session lock we hold
+			Annotate("anomaly", "Grafana session renewal failed")
+			g.session.retryTimer = time.AfterFunc(sessionRenewalRetryDelay, func() {
+				g.retryRenewal(generation)
+			})
+		}
+		return err
+	}
+
+	g.setSession(cookie, maxAge)
+	g.session.refreshCount++
+	pushSessionResult(g.session.refreshCount)
+	return nil
+}
+
+// retryRenewal clears the error of the failed renewal and renews the session again
+func (g *GrafanaProxy) retryRenewal(generation int) {
+	g.session.mutex.Lock()
+	g.session.renewErr = nil
+	g.session.retryTimer = nil
+	g.session.mutex.Unlock()
+
+	g.renewSession(generation)
+}
+
+// renewalResult returns the error of the renewal of the given generation, nil if the session was renewed
+func (g *GrafanaProxy) renewalResult(generation int) error {
+	g.session.mutex.RLock()
+	defer g.session.mutex.RUnlock()
+
+	if generation != g.session.generation {
+		return nil
+	}
+	return g.session.renewErr
+}
+
+// setSession swaps the session cookie and schedules its renewal. The caller must hold the session write lock
+func (g *GrafanaProxy) setSession(cookie string, maxAge int) {
+	g.session.cookie = cookie
+	g.session.generation++
+	generation := g.session.generation
+
+	time.AfterFunc(time.Duration(maxAge)*time.Second, func() {
+		g.renewSession(generation)
+	})
+}
+
+// login opens a new session and returns its cookie and how long it is valid (in seconds)
+// It doesn't touch g.session, so it runs without the session lock
+func (g *GrafanaProxy) login() (string, int, error) {
+	log.Trace("Grafana login() start")
+	defer log.Trace("Grafana login() end")
+	loginURL := fmt.Sprintf("%s/login", config.GrafanaURL)
+
+	payload := []byte(fmt.Sprintf(`{"user":"%s","email":"","password":"%s"}`, config.GrafanaUser, config.GrafanaPassword))
+	req, err := http.NewRequest("POST", loginURL, bytes.NewBuffer(payload))
+	if err != nil {
+		return "", 0, appError.NewInitializationError("error creating the HTTP request", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := g.httpAPIclient.Do(req)
+	if response != nil {
+		defer response.Body.Close()
+	}
+
+	if err != nil {
+		return "", 0, appError.NewInitializationError("error while sending the login request", err)
+	}
+	if response.StatusCode >= 400 {
+		return "", 0, appError.NewInitializationError(fmt.Sprintf("error while sending the login request. HTTP status: %d", response.StatusCode), nil)
+	}
+
+	// TODO: This part seems brittle using hardcoded array index access (response.Header["Set-Cookie"][0], match[1] & strconv.Atoi(match[2])
+	// It's probably possible to refactor this to something cleaner
+	if response.Header["Set-Cookie"] == nil {
+		return "", 0, appError.NewInitializationError("no session cookie in the login response", nil)
+	}
+
+	headerCookie := response.Header["Set-Cookie"][0]
+	match := cookieRegexp.FindStringSubmatch(headerCookie)
+
+	if len(match) < 3 {
+		return "", 0, appError.NewInitializationError(fmt.Sprintf("unexpected match length for login cookie. response.Header[\"Set-Cookie\"]=%s", response.Header["Set-Cookie"]), nil)
+	}
+
+	maxage, parseErr := strconv.Atoi(match[2])
+	if parseErr != nil || maxage < 5 {
+		maxage = 5 // retry in 5s
+		log.Warn("Grafana: Unexpected maxage value in the cookie response header. Defaulting to 5s.")
+	}
+
+	if config.GrafanaOrgID != 0 {
+		err = g.switchOrg(match[1])
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	log.Debugf("Grafana: Successfully logged in. Cookie valid for %d seconds", maxage)
+
+	return match[1], maxage, nil
+}
+
+// switchOrg makes config.GrafanaOrgID the current organization of the session with the given cookie
+func (g *GrafanaProxy) switchOrg(cookie string) error {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/user/using/%d", config.GrafanaURL, config.GrafanaOrgID), nil)
+	if err != nil {
+		return appError.NewInitializationError("error creating the HTTP request", err)
+	}
+	req.Header.Set("cookie", cookie)
+
+	response, err := g.httpAPIclient.Do(req)
+	if response != nil {
+		defer response.Body.Close()
+	}
+
+	if err != nil {
+		return appError.NewInitializationError("error while sending the organization switch request", err)
+	}
+	if response.StatusCode >= 400 {
+		return appError.NewInitializationError(fmt.Sprintf("error while switching to the Grafana organization %d. HTTP status: %d", config.GrafanaOrgID, response.StatusCode), nil)
+	}
+
+	log.Debugf("Grafana: Switched to organization %d", config.GrafanaOrgID)
+	return nil
+}
+
+func pushSessionResult(refreshCount int) {
+	select {
+	case dataout.ResultChan <- dataout.Result{Timestamp: time.Now().Unix(), Name: fmt.Sprintf("%s.grafana.auth.refresh.count", config.SandboxID), Value: strconv.Itoa(refreshCount)}:
+	default:
+		log.Error("Channel full, discarding result")
+	}
+}
@@ -0,0 +1,247 @@
+package datasource
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+
+	"github.com/aleveille/tems/config"
+	log "github.com/aleveille/tems/logger"
+)
+
+// sandboxTopology keeps the ASGs and instances of the sandbox in stable slots. The infra metrics are numbered after
+// the slots (infra.tsdb-asg-N, infra.tsdb-node-N) so a replacement instance takes over the slot, and the metrics,
+// of the instance it replaces. The ASG in slot N owns the instance slots [N*instancesPerASG, (N+1)*instancesPerASG).
+type sandboxTopology struct {
+	mutex           sync.RWMutex
+	instancesPerASG int
+	discovered      bool
+
+	asgNames    []string
+	instanceIDs []string
+
+	// ASGs and instances that didn't fit in a slot ("ASG" or "Instance" by name), to only report them once
+	overflow map[string]string
+
+	// The metadata of each instance of the slots, see refreshInstanceMetadata()
+	instances map[string]*instanceMetadata
+
+	// Whether the instances couldn't be described, to only warn once
+	metadataFailing bool
+}
+
+func newSandboxTopology(asgCount int, instancesPerASG int) *sandboxTopology {
+	return &sandboxTopology{
+		instancesPerASG: instancesPerASG,
+		asgNames:        make([]string, asgCount),
+		instanceIDs:     make([]string, asgCount*instancesPerASG),
+		overflow:        map[string]string{},
+		instances:       map[string]*instanceMetadata{},
+	}
+}
+
+// Topology returns a copy of the ASG names and instance IDs, indexed by slot. Empty slots are empty strings
+func (a *AWSProxy) Topology() ([]string, []string) {
+	a.topology.mutex.RLock()
+	defer a.topology.mutex.RUnlock()
+
+	return append([]string{}, a.topology.asgNames...), append([]string{}, a.topology.instanceIDs...)
+}
+
+// Volumes returns a copy of the EBS volume IDs of each instance, by device name order
+func (a *AWSProxy) Volumes() map[string][]string {
+	a.topology.mutex.RLock()
+	defer a.topology.mutex.RUnlock()
+
+	volumes := make(map[string][]string, len(a.topology.instances))
+	for instanceID, metadata := range a.topology.instances {
+		for _, volume := range metadata.Volumes {
+			volumes[instanceID] = append(volumes[instanceID], volume.VolumeID)
+		}
+	}
+
+	return volumes
+}
+
+// RefreshTopology discovers the ASGs and instances of the sandbox again and updates the slots
+// The instances joining or leaving the sandbox after the first discovery are logged and annotated
+func (a *AWSProxy) RefreshTopology() error {
+	groups, err := a.findSandboxAutoscalingGroups()
+	if err != nil {
+		return err
+	}
+
+	events, first := a.topology.update(groups)
+	asgNames, instanceIDs := a.Topology()
+	if first {
+		log.Debugf("asgNames: %s\n", asgNames)
+		log.Debugf("instanceIDs: %s\n", instanceIDs)
+
+		if len(groups) == 0 {
+			log.Warn("No ASG found for the sandbox")
+		}
+	}
+
+	for _, event := range events {
+		log.Info(event)
+		Annotate("scale", event)
+	}
+
+	metadataChanged, err := a.refreshInstanceMetadata(instanceIDs)
+	if err != nil {
+		// The volumes are needed by the EBS metrics, the rest of the metadata only tags the results
+		if config.AWSEBSVolumeMetrics {
+			return err
+		}
+		if !a.topology.setMetadataFailing(true) {
+			log.Warnf("Error while describing the instances of the sandbox, the infra results won't have their metadata:\n%s\n", err)
+		}
+	} else {
+		a.topology.setMetadataFailing(false)
+	}
+
+	// The first manifest is written once the run starts, see WriteRunManifest()
+	if !first && (len(events) > 0 || metadataChanged) {
+		WriteRunManifest()
+	}
+
+	return nil
+}
+
+// update assigns the slots from the discovered groups. It returns the join/leave events and whether it was the first discovery
+func (t *sandboxTopology) update(groups []*autoscaling.Group) ([]string, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	events := []string{}
+	overflow := map[string]string{}
+
+	groupsByName := map[string]*autoscaling.Group{}
+	for _, group := range groups {
+		groupsByName[aws.StringValue(group.AutoScalingGroupName)] = group
+	}
+
+	// ASGs that left free their slot and the slots of their instances
+	for asgSlot, asgName := range t.asgNames {
+		if asgName == "" {
+			continue
+		}
+		if _, ok := groupsByName[asgName]; !ok {
+			events = append(events, fmt.Sprintf("ASG %s left the sandbox (tsdb-asg-%d)", asgName, asgSlot+1))
+			t.asgNames[asgSlot] = ""
+		}
+	}
+
+	for _, group := range groups {
+		asgName := aws.StringValue(group.AutoScalingGroupName)
+		asgSlot := indexOf(t.asgNames, asgName)
+		if asgSlot < 0 {
+			asgSlot = indexOf(t.asgNames, "")
+			if asgSlot < 0 {
+				overflow[asgName] = "ASG"
+				if _, known := t.overflow[asgName]; !known {
+					log.Errorf("found more ASGs than expected, ignoring %s\n", asgName)
+					if t.discovered {
+						events = append(events, fmt.Sprintf("ASG %s joined the sandbox without a slot (more than %d ASGs), its metrics aren't collected", asgName, len(t.asgNames)))
+					}
+				}
+				continue
+			}
+
+			t.asgNames[asgSlot] = asgName
+			if t.discovered {
+				events = append(events, fmt.Sprintf("ASG %s joined the sandbox (tsdb-asg-%d)", asgName, asgSlot+1))
+			}
+		}
+
+		instanceIDs := []string{}
+		for _, instance := range group.Instances {
+			// A terminating instance is being replaced, its slot goes to the replacement right away
+			state := aws.StringValue(instance.LifecycleState)
+			if strings.HasPrefix(state, "Terminat") || strings.HasPrefix(state, "Detach") {
+				continue
+			}
+			instanceIDs = append(instanceIDs, aws.StringValue(instance.InstanceId))
+		}
+		sort.Strings(instanceIDs)
+
+		events = append(events, t.updateInstanceSlots(asgName, asgSlot, instanceIDs, overflow)...)
+	}
+
+	// The instances of the ASGs that left
+	for asgSlot, asgName := range t.asgNames {
+		if asgName == "" {
+			events = append(events, t.updateInstanceSlots(asgName, asgSlot, []string{}, overflow)...)
+		}
+	}
+
+	// The ASGs and instances without a slot that are gone, and didn't take a freed slot
+	goneOverflow := []string{}
+	for name := range t.overflow {
+		if _, ok := overflow[name]; !ok && indexOf(t.asgNames, name) < 0 && indexOf(t.instanceIDs, name) < 0 {
+			goneOverflow = append(goneOverflow, name)
+		}
+	}
+	sort.Strings(goneOverflow)
+	for _, name := range goneOverflow {
+		events = append(events, fmt.Sprintf("%s %s left the sandbox (without a slot)", t.overflow[name], name))
+	}
+
+	first := !t.discovered
+	t.discovered = true
+	t.overflow = overflow
+
+	return events, first
+}
+
+// updateInstanceSlots updates the instance slots of an ASG. The caller must hold the write lock
+func (t *sandboxTopology) updateInstanceSlots(asgName string, asgSlot int, instanceIDs []string, overflow map[string]string) []string {
+	events := []string{}
+	slots := t.instanceIDs[asgSlot*t.instancesPerASG : (asgSlot+1)*t.instancesPerASG]
+
+	for index, instanceID := range slots {
+		if instanceID != "" && indexOf(instanceIDs, instanceID) < 0 {
+			events = append(events, fmt.Sprintf("Instance %s left the sandbox (tsdb-node-%d)", instanceID, asgSlot*t.instancesPerASG+index+1))
+			slots[index] = ""
+		}
+	}
+
+	for _, instanceID := range instanceIDs {
+		if indexOf(slots, instanceID) >= 0 {
+			continue
+		}
+
+		index := indexOf(slots, "")
+		if index < 0 {
+			overflow[instanceID] = "Instance"
+			if _, known := t.overflow[instanceID]; !known {
+				log.Errorf("found too many instances in ASG %s, ignoring %s\n", asgName, instanceID)
+				if t.discovered {
+					events = append(events, fmt.Sprintf("Instance %s joined the sandbox without a slot (more than %d instances in ASG %s), its metrics aren't collected", instanceID, t.instancesPerASG, asgName))
+				}
+			}
+			continue
+		}
+
+		slots[index] = instanceID
+		if t.discovered {
+			events = append(events, fmt.Sprintf("Instance %s joined the sandbox (tsdb-node-%d)", instanceID, asgSlot*t.instancesPerASG+index+1))
+		}
+	}
+
+	return events
+}
+
+func indexOf(values []string, value string) int {
+	for index, v := range values {
+		if v == value {
+			return index
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,216 @@
+package datasource
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+
+	log "github.com/aleveille/tems/logger"
+)
+
+func TestMain(m *testing.M) {
+	log.InitLogger()
+	os.Exit(m.Run())
+}
+
+// testGroup returns an ASG whose instances are given as "id" (InService) or "id:state"
+func testGroup(name string, instances ...string) *autoscaling.Group {
+	group := &autoscaling.Group{AutoScalingGroupName: aws.String(name)}
+	for _, instance := range instances {
+		state := "InService"
+		if parts := strings.SplitN(instance, ":", 2); len(parts) == 2 {
+			instance, state = parts[0], parts[1]
+		}
+		group.Instances = append(group.Instances, &autoscaling.Instance{InstanceId: aws.String(instance), LifecycleState: aws.String(state)})
+	}
+
+	return group
+}
+
+func TestSandboxTopologyUpdate(t *testing.T) {
+	tests := []struct {
+		name            string
+		asgCount        int
+		instancesPerASG int
+		// The discovery before the tested one, if any
+		previous []*autoscaling.Group
+		groups   []*autoscaling.Group
+
+		asgNames    []string
+		instanceIDs []string
+		events      []string
+		first       bool
+		overflow    []string
+	}{
+		{
+			name:            "first discovery",
+			asgCount:        2,
+			instancesPerASG: 2,
+			groups:          []*autoscaling.Group{testGroup("asg-a", "i-2", "i-1"), testGroup("asg-b", "i-3")},
+			asgNames:        []string{"asg-a", "asg-b"},
+			instanceIDs:     []string{"i-1", "i-2", "i-3", ""},
+			events:          []string{},
+			first:           true,
+		},
+		{
+			name:            "unchanged",
+			asgCount:        2,
+			instancesPerASG: 2,
+			previous:        []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2"), testGroup("asg-b", "i-3", "i-4")},
+			groups:          []*autoscaling.Group{testGroup("asg-b", "i-4", "i-3"), testGroup("asg-a", "i-1", "i-2")},
+			asgNames:        []string{"asg-a", "asg-b"},
+			instanceIDs:     []string{"i-1", "i-2", "i-3", "i-4"},
+			events:          []string{},
+		},
+		{
+			name:            "an ASG leaves while another joins",
+			asgCount:        2,
+			instancesPerASG: 2,
+			previous:        []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2"), testGroup("asg-b", "i-3", "i-4")},
+			groups:          []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2"), testGroup("asg-c", "i-5", "i-6")},
+			asgNames:        []string{"asg-a", "asg-c"},
+			instanceIDs:     []string{"i-1", "i-2", "i-5", "i-6"},
+			events: []string{
+				"ASG asg-b left the sandbox (tsdb-asg-2)",
+				"ASG asg-c joined the sandbox (tsdb-asg-2)",
+				"Instance i-3 left the sandbox (tsdb-node-3)",
+				"Instance i-4 left the sandbox (tsdb-node-4)",
+				"Instance i-5 joined the sandbox (tsdb-node-3)",
+				"Instance i-6 joined the sandbox (tsdb-node-4)",
+			},
+		},
+		{
+			name:            "an ASG leaves",
+			asgCount:        2,
+			instancesPerASG: 1,
+			previous:        []*autoscaling.Group{testGroup("asg-a", "i-1"), testGroup("asg-b", "i-2")},
+			groups:          []*autoscaling.Group{testGroup("asg-b", "i-2")},
+			asgNames:        []string{"", "asg-b"},
+			instanceIDs:     []string{"", "i-2"},
+			events: []string{
+				"ASG asg-a left the sandbox (tsdb-asg-1)",
+				"Instance i-1 left the sandbox (tsdb-node-1)",
+			},
+		},
+		{
+			name:            "a terminating instance gives its slot to its replacement",
+			asgCount:        1,
+			instancesPerASG: 2,
+			previous:        []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2")},
+			groups:          []*autoscaling.Group{testGroup("asg-a", "i-1:Terminating:Wait", "i-2", "i-3:Pending")},
+			asgNames:        []string{"asg-a"},
+			instanceIDs:     []string{"i-3", "i-2"},
+			events: []string{
+				"Instance i-1 left the sandbox (tsdb-node-1)",
+				"Instance i-3 joined the sandbox (tsdb-node-1)",
+			},
+		},
+		{
+			name:            "a detaching instance leaves",
+			asgCount:        1,
+			instancesPerASG: 2,
+			previous:        []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2")},
+			groups:          []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2:Detaching")},
+			asgNames:        []string{"asg-a"},
+			instanceIDs:     []string{"i-1", ""},
+			events:          []string{"Instance i-2 left the sandbox (tsdb-node-2)"},
+		},
+		{
+			name:            "more ASGs and instances than slots",
+			asgCount:        1,
+			instancesPerASG: 1,
+			groups:          []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2"), testGroup("asg-b", "i-3")},
+			asgNames:        []string{"asg-a"},
+			instanceIDs:     []string{"i-1"},
+			events:          []string{},
+			first:           true,
+			overflow:        []string{"asg-b", "i-2"},
+		},
+		{
+			name:            "scale-out past the expected instances",
+			asgCount:        1,
+			instancesPerASG: 2,
+			previous:        []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2")},
+			groups:          []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2", "i-3")},
+			asgNames:        []string{"asg-a"},
+			instanceIDs:     []string{"i-1", "i-2"},
+			events:          []string{"Instance i-3 joined the sandbox without a slot (more than 2 instances in ASG asg-a), its metrics aren't collected"},
+			overflow:        []string{"i-3"},
+		},
+		{
+			name:            "an extra ASG joins",
+			asgCount:        1,
+			instancesPerASG: 1,
+			previous:        []*autoscaling.Group{testGroup("asg-a", "i-1")},
+			groups:          []*autoscaling.Group{testGroup("asg-a", "i-1"), testGroup("asg-b", "i-2")},
+			asgNames:        []string{"asg-a"},
+			instanceIDs:     []string{"i-1"},
+			events:          []string{"ASG asg-b joined the sandbox without a slot (more than 1 ASGs), its metrics aren't collected"},
+			overflow:        []string{"asg-b"},
+		},
+		{
+			name:            "instances and ASGs without a slot leave",
+			asgCount:        1,
+			instancesPerASG: 1,
+			previous:        []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2"), testGroup("asg-b", "i-3")},
+			groups:          []*autoscaling.Group{testGroup("asg-a", "i-1")},
+			asgNames:        []string{"asg-a"},
+			instanceIDs:     []string{"i-1"},
+			events: []string{
+				"ASG asg-b left the sandbox (without a slot)",
+				"Instance i-2 left the sandbox (without a slot)",
+			},
+		},
+		{
+			name:            "an overflowing instance takes a freed slot",
+			asgCount:        1,
+			instancesPerASG: 1,
+			previous:        []*autoscaling.Group{testGroup("asg-a", "i-1", "i-2")},
+			groups:          []*autoscaling.Group{testGroup("asg-a", "i-2")},
+			asgNames:        []string{"asg-a"},
+			instanceIDs:     []string{"i-2"},
+			events: []string{
+				"Instance i-1 left the sandbox (tsdb-node-1)",
+				"Instance i-2 joined the sandbox (tsdb-node-1)",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			topology := newSandboxTopology(test.asgCount, test.instancesPerASG)
+			if test.previous != nil {
+				topology.update(test.previous)
+			}
+
+			events, first := topology.update(test.groups)
+
+			if !reflect.DeepEqual(topology.asgNames, test.asgNames) {
+				t.Errorf("asgNames = %q, want %q", topology.asgNames, test.asgNames)
+			}
+			if !reflect.DeepEqual(topology.instanceIDs, test.instanceIDs) {
+				t.Errorf("instanceIDs = %q, want %q", topology.instanceIDs, test.instanceIDs)
+			}
+			if !reflect.DeepEqual(events, test.events) {
+				t.Errorf("events = %q, want %q", events, test.events)
+			}
+			if first != test.first {
+				t.Errorf("first = %t, want %t", first, test.first)
+			}
+
+			overflow := []string{}
+			for name := range topology.overflow {
+				overflow = append(overflow, name)
+			}
+			sort.Strings(overflow)
+			if want := append([]string{}, test.overflow...); !reflect.DeepEqual(overflow, want) {
+				t.Errorf("overflow = %q, want %q", overflow, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package datasource
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	// PostgreSQL driver used to talk directly to Timescale
+	_ "github.com/lib/pq"
+
+	"github.com/aleveille/tems/archive"
+	"github.com/aleveille/tems/config"
+	appError "github.com/aleveille/tems/error"
+	"github.com/aleveille/tems/httpclient"
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	// TSDBProxyInstance is the globally accessible TSDBProxy struct
+	TSDBProxyInstance TSDBProxy
+
+	// IRONdb httptrap module, see https://docs.circonus.com/irondb/
+	irondbWriteURL     = "%s/module/httptrap/%s/%s"
+	irondbWritePayload = `{"%s": {"_type": "n", "_value": %s, "_ts": %d}}`
+
+	// InfluxDB 1.x line protocol write API
+	influxdbWriteURL     = "%s/write?db=%s&precision=ms"
+	influxdbWritePayload = "%s,sandbox=%s value=%s %d"
+
+	// Direct InfluxDB Flux API (InfluxDB 1.8+)
+	fluxdbDirectQueryPath = "/api/v2/query?org=my-org"
+
+	// Grafana PostgreSQL macros used by the Timescale queries, see expandGrafanaSQLMacros()
+	timeGroupAliasMacroRegex = regexp.MustCompile(`\$__timeGroupAlias\(([^,]+),[^)]*\)`)
+	timeGroupMacroRegex      = regexp.MustCompile(`\$__timeGroup\(([^,]+),[^)]*\)`)
+	timeFilterMacroRegex     = regexp.MustCompile(`\$__timeFilter\(([^)]+)\)`)
+
+	timescaleCanaryTableCreate = `CREATE TABLE IF NOT EXISTS tems_canary ("time" TIMESTAMPTZ NOT NULL, value DOUBLE PRECISION NOT NULL)`
+	timescaleCanaryInsert      = `INSERT INTO tems_canary ("time", value) VALUES ($1, $2)`
+)
+
+// TSDBProxy is our wrapper around the native API of the TSDB under test, bypassing Grafana
+// It uses the HTTP API for IRONdb and InfluxDB and the PostgreSQL wire protocol for Timescale
+type TSDBProxy struct {
+	httpAPIclient *http.Client
+	db            *sql.DB
+}
+
+// InitTSDBProxy initialize the TSDBProxy struct in order to interact with the TSDB under test
+func InitTSDBProxy() (*TSDBProxy, error) {
+	log.Debug("InitTSDBProxy() start")
+	defer log.Debug("InitTSDBProxy() end")
+	proxy := TSDBProxy{}
+
+	proxy.httpAPIclient = tsdbHTTPAPIclientSetup()
+
+	if config.TSDBSystem == "timescale" {
+		err := proxy.openTimescaleDB()
+		if err != nil {
+			return &proxy, err
+		}
+	}
+
+	TSDBProxyInstance = proxy
+	return &proxy, nil
+}
+
+func tsdbHTTPAPIclientSetup() *http.Client {
+	return httpclient.New(httpclient.TSDBClient, httpclient.Settings{
+		Timeout:             config.HTTPQueryTimeout,
+		DialTimeout:         500 * time.Millisecond,
+		TLSHandshakeTimeout: 1000 * time.Millisecond,
+		Sandbox:             true,
+	})
+}
+
+func (t *TSDBProxy) openTimescaleDB() error {
+	log.Trace("TSDB openTimescaleDB() start")
+	defer log.Trace("TSDB openTimescaleDB() end")
+
+	db, err := sql.Open("postgres", config.TimescaleDSN)
+	if err != nil {
+		return appError.NewInitializationError("error while opening the Timescale connection", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return appError.NewInitializationError("error while connecting to Timescale", err)
+	}
+
+	if config.Canary {
+		_, err = db.Exec(timescaleCanaryTableCreate)
+		if err != nil {
+			return appError.NewInitializationError("error while creating the Timescale canary table", err)
+		}
+	}
+
+	t.db = db
+	return nil
+}
+
+// WritePoint will write a single numeric point through the TSDB native write API
+func (t *TSDBProxy) WritePoint(metricName string, value string, timestamp time.Time) error {
+	switch config.TSDBSystem {
+	case "irondb":
+		formattedWriteURL := fmt.Sprintf(irondbWriteURL, config.TSDBURL, config.IRONdbCheckUUID, url.PathEscape(config.IRONdbCheckSecret))
+		payload := fmt.Sprintf(irondbWritePayload, metricName, value, timestamp.UnixNano()/int64(time.Millisecond))
+		return t.doHTTPWrite("PUT", formattedWriteURL, "application/json", payload)
+	case "influxdb":
+		formattedWriteURL := fmt.Sprintf(influxdbWriteURL, config.TSDBURL, url.QueryEscape(config.InfluxDBDatabaseName))
+		payload := fmt.Sprintf(influxdbWritePayload, metricName, config.SandboxID, value, timestamp.UnixNano()/int64(time.Millisecond))
+		return t.doHTTPWrite("POST", formattedWriteURL, "text/plain", payload)
+	case "timescale":
+		// Timescale only has the canary table for now, so the metric name isn't used
+		_, err := t.db.Exec(timescaleCanaryInsert, timestamp, value)
+		if err != nil {
+			return fmt.Errorf("error while inserting the point in Timescale:\n\t%s", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("writing points to %s is not supported", config.TSDBSystem)
+	}
+}
+
+func (t *TSDBProxy) doHTTPWrite(method string, writeURL string, contentType string, payload string) error {
+	req, err := http.NewRequest(method, writeURL, strings.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error creating the HTTP write request:\n\t%s", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	_, err = t.doHTTPRequest(req, "write")
+	return err
+}
+
+// doHTTPRequest will send the request to the TSDB and return the response body
+// apiName is only used to give some context in the error messages (eg: CAQL, write)
+func (t *TSDBProxy) doHTTPRequest(req *http.Request, apiName string) ([]byte, error) {
+	log.Tracef("%s request sent to the TSDB: URL=%v", req.Method, req.URL)
+
+	requestStartTime := time.Now()
+	response, err := t.httpAPIclient.Do(req)
+	if response != nil {
+		defer response.Body.Close()
+	}
+
+	if err != nil {
+		archive.RecordHTTP(httpclient.TSDBClient, req, nil, nil, time.Since(requestStartTime), err)
+		return nil, fmt.Errorf("net/client request error while calling the TSDB %s API:\n\t%s", apiName, err)
+	}
+
+	// The body of the failed requests is read as well, for the archive
+	body, ioErr := ioutil.ReadAll(response.Body)
+	archive.RecordHTTP(httpclient.TSDBClient, req, response, body, time.Since(requestStartTime), ioErr)
+
+	if response.StatusCode >= 400 {
+		return nil, fmt.Errorf("unexpected HTTP status code error while calling the TSDB %s API. HTTP status: %d", apiName, response.StatusCode)
+	}
+	if ioErr != nil {
+		return nil, fmt.Errorf("io error while reading HTTP response body:\n%s", ioErr)
+	}
+
+	return body, nil
+}
+
+func (t *TSDBProxy) doDirectCAQLHTTPQuery(queryString string, startTimestamp int64, endTimestamp int64, period int64) (string, error) {
+	formattedCaqlURL := config.TSDBURL + fmt.Sprintf(caqlQueryPath, startTimestamp, endTimestamp, period, queryString)
+	req, _ := http.NewRequest("GET", formattedCaqlURL, nil)
+	req.Header.Add("x-circonus-account", config.IRONdbAccountID)
+
+	body, err := t.doHTTPRequest(req, "CAQL")
+	if err != nil {
+		return "nan", err
+	}
+
+	return parseCAQLResponse(body)
+}
+
+func (t *TSDBProxy) doDirectIRONdbFindHTTPQuery(findPath string) (string, error) {
+	req, _ := http.NewRequest("GET", config.TSDBURL+findPath, nil)
+	req.Header.Add("x-circonus-account", config.IRONdbAccountID)
+
+	body, err := t.doHTTPRequest(req, "IRONdb find")
+	if err != nil {
+		return "nan", err
+	}
+
+	return parseIRONdbFindResponse(body)
+}
+
+func (t *TSDBProxy) doDirectInfluxDBHTTPRequest(db string, queryString string, epoch string) ([]byte, error) {
+	formattedQueryURL := config.TSDBURL + fmt.Sprintf(influxdbQueryPath, db, url.PathEscape(queryString), epoch)
+	req, _ := http.NewRequest("GET", formattedQueryURL, nil)
+
+	return t.doHTTPRequest(req, "InfluxDB")
+}
+
+func (t *TSDBProxy) doDirectInfluxDBHTTPQuery(db string, queryString string, epoch string) (string, error) {
+	body, err := t.doDirectInfluxDBHTTPRequest(db, queryString, epoch)
+	if err != nil {
+		return "nan", err
+	}
+
+	return parseInfluxDBResponse(body, queryString)
+}
+
+func (t *TSDBProxy) doDirectInfluxDBMetadataHTTPQuery(db string, queryString string) (string, error) {
+	body, err := t.doDirectInfluxDBHTTPRequest(db, queryString, config.InfluxDBEpoch)
+	if err != nil {
+		return "nan", err
+	}
+
+	return parseInfluxDBMetadataResponse(body)
+}
+
+func (t *TSDBProxy) doDirectFluxDBHTTPQuery(queryString string) (string, error) {
+	req, _ := http.NewRequest("POST", config.TSDBURL+fluxdbDirectQueryPath, bytes.NewBuffer([]byte(queryString)))
+	req.Header.Set("Content-Type", "application/vnd.flux")
+	req.Header.Set("Accept", "application/csv")
+
+	body, err := t.doHTTPRequest(req, "Flux")
+	if err != nil {
+		return "nan", err
+	}
+
+	return parseFluxResponse(body)
+}
+
+// doDirectTimescaleDBQuery will run the query through the PostgreSQL connection and return the value of the last row
+func (t *TSDBProxy) doDirectTimescaleDBQuery(queryString string, startTimestamp int64, endTimestamp int64, intervalMs int64) (string, error) {
+	rows, err := t.db.Query(expandGrafanaSQLMacros(queryString, startTimestamp, endTimestamp, intervalMs))
+	if err != nil {
+		return "nan", fmt.Errorf("error while querying Timescale:\n\t%s", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "nan", fmt.Errorf("error while reading the Timescale columns:\n\t%s", err)
+	}
+
+	// Like Grafana's time series format, the value is the last column that isn't the time or the series name
+	valueIndex := -1
+	for index, column := range columns {
+		if column != "time" && column != "metric" {
+			valueIndex = index
+		}
+	}
+	if valueIndex == -1 {
+		return "nan", fmt.Errorf("no value column in the Timescale result (columns: %v)", columns)
+	}
+
+	values := make([]interface{}, len(columns))
+	valuePointers := make([]interface{}, len(columns))
+	for index := range values {
+		valuePointers[index] = &values[index]
+	}
+
+	result := "nan"
+	for rows.Next() {
+		err = rows.Scan(valuePointers...)
+		if err != nil {
+			return "nan", fmt.Errorf("error while reading a Timescale row:\n\t%s", err)
+		}
+		result = formatSQLValue(values[valueIndex])
+	}
+
+	return result, rows.Err()
+}
+
+// doDirectTimescaleDBMetadataQuery will run the query through the PostgreSQL connection and return the number of rows
+func (t *TSDBProxy) doDirectTimescaleDBMetadataQuery(queryString string, startTimestamp int64, endTimestamp int64) (string, error) {
+	rows, err := t.db.Query(expandGrafanaSQLMacros(queryString, startTimestamp, endTimestamp, defaultIntervalMs))
+	if err != nil {
+		return "nan", fmt.Errorf("error while querying Timescale:\n\t%s", err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		count++
+	}
+
+	return strconv.Itoa(count), rows.Err()
+}
+
+// expandGrafanaSQLMacros replaces the Grafana PostgreSQL macros used by the Timescale queries with plain SQL, the way
+// the Grafana PostgreSQL datasource does with the TimescaleDB option enabled. The timestamps are in ms.
+// The queries are written to be embedded in a JSON body, so the escaped double quotes are unescaped as well.
+func expandGrafanaSQLMacros(queryString string, startTimestamp int64, endTimestamp int64, intervalMs int64) string {
+	interval := fmt.Sprintf("%dms", intervalMs)
+	start := time.Unix(0, startTimestamp*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+	end := time.Unix(0, endTimestamp*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+
+	sql := strings.Replace(queryString, `\"`, `"`, -1)
+	sql = timeGroupAliasMacroRegex.ReplaceAllString(sql, fmt.Sprintf(`time_bucket('%s', $1) AS "time"`, interval))
+	sql = timeGroupMacroRegex.ReplaceAllString(sql, fmt.Sprintf(`time_bucket('%s', $1)`, interval))
+	sql = timeFilterMacroRegex.ReplaceAllString(sql, fmt.Sprintf(`$1 BETWEEN '%s' AND '%s'`, start, end))
+	sql = strings.Replace(sql, "$__interval", interval, -1)
+
+	return sql
+}
+
+func formatSQLValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "nan"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
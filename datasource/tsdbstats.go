@@ -0,0 +1,240 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aleveille/tems/config"
+	"github.com/aleveille/tems/dataout"
+	log "github.com/aleveille/tems/logger"
+)
+
+// The internal statistics of the TSDB explain why a query got slower (cache misses, compaction backlog, WAL growth)
+// They are reported as tsdb.stats.<name>. For IRONdb and InfluxDB, each statistic is the sum of the JSON values matching
+// its paths (dot-separated, with wildcards in the segments), see config.TSDBStatsPaths to collect other ones
+
+var (
+	irondbStatsPath   = "/stats.json"
+	influxdbStatsPath = "/debug/vars"
+
+	// The jobq backlogs show the work IRONdb can't keep up with (rollups, replication, reads)
+	irondbDefaultStats = map[string][]string{
+		"jobq.backlog":  {"mtev.eventer.jobq.*.backlog"},
+		"jobq.inflight": {"mtev.eventer.jobq.*.inflight"},
+	}
+
+	// The /debug/vars entries with a name and values (eg: "tsm1_cache:/var/lib/influxdb/data/mydb/autogen/2") are
+	// summed across shards under <name>.<value>, see flattenInfluxDBVars()
+	influxdbDefaultStats = map[string][]string{
+		"cache.size.bytes":  {"tsm1_cache.memBytes"},
+		"wal.size.bytes":    {"tsm1_wal.currentSegmentDiskBytes", "tsm1_wal.oldSegmentsDiskBytes"},
+		"compaction.queue":  {"tsm1_engine.tsm*CompactionQueue"},
+		"compaction.active": {"tsm1_engine.*CompactionsActive"},
+		"shard.disk.bytes":  {"shard.diskBytes"},
+		"series.count":      {"database.numSeries"},
+		"heap.inuse.bytes":  {"memstats.HeapInuse"},
+	}
+
+	// Each Timescale statistic is a query returning a single number
+	timescaleStats = map[string]string{
+		"cache.hit.ratio":         `SELECT sum(blks_hit)::float / nullif(sum(blks_hit) + sum(blks_read), 0) FROM pg_stat_database WHERE datname = current_database()`,
+		"database.size.bytes":     `SELECT pg_database_size(current_database())`,
+		"connections.count":       `SELECT count(*) FROM pg_stat_activity WHERE datname = current_database()`,
+		"dead.tuples.count":       `SELECT coalesce(sum(n_dead_tup), 0) FROM pg_stat_user_tables`,
+		"wal.size.bytes":          `SELECT coalesce(sum(size), 0) FROM pg_ls_waldir()`,
+		"chunks.count":            `SELECT count(*) FROM timescaledb_information.chunks`,
+		"chunks.compressed.count": `SELECT count(*) FROM timescaledb_information.chunks WHERE is_compressed`,
+		"jobs.failed.count":       `SELECT count(*) FROM timescaledb_information.job_stats WHERE last_run_status = 'Failed'`,
+	}
+)
+
+// statLeaf is a numeric value of a statistics document, with the path leading to it
+type statLeaf struct {
+	path  []string
+	value float64
+}
+
+// TSDBStatsMetrics returns the metric names (relative to the sandbox ID) reported by CollectTSDBStats()
+func TSDBStatsMetrics() []string {
+	names := []string{}
+	if config.TSDBSystem == "timescale" {
+		for name := range timescaleStats {
+			names = append(names, "tsdb.stats."+name)
+		}
+	} else {
+		for name := range tsdbStatPaths() {
+			names = append(names, "tsdb.stats."+name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func tsdbStatPaths() map[string][]string {
+	if len(config.TSDBStatsPathMap) > 0 {
+		return config.TSDBStatsPathMap
+	}
+	if config.TSDBSystem == "irondb" {
+		return irondbDefaultStats
+	}
+
+	return influxdbDefaultStats
+}
+
+// CollectTSDBStats pushes the internal statistics of the TSDB to the result channel
+func CollectTSDBStats() {
+	now := time.Now()
+
+	switch config.TSDBSystem {
+	case "irondb":
+		leaves, err := TSDBProxyInstance.fetchStatsDocument(irondbStatsPath, flattenStats)
+		if err != nil {
+			log.Errorf("Error while collecting the IRONdb statistics:\n%s\n", err)
+			return
+		}
+		pushStatLeaves(leaves, now)
+	case "influxdb":
+		leaves, err := TSDBProxyInstance.fetchStatsDocument(influxdbStatsPath, flattenInfluxDBVars)
+		if err != nil {
+			log.Errorf("Error while collecting the InfluxDB statistics:\n%s\n", err)
+			return
+		}
+		pushStatLeaves(leaves, now)
+	case "timescale":
+		for name, query := range timescaleStats {
+			var value *float64
+			err := TSDBProxyInstance.db.QueryRow(query).Scan(&value)
+			if err != nil {
+				// Some views need the pg_monitor role, or a recent TimescaleDB
+				log.Debugf("Error while collecting the Timescale statistic %s: %v", name, err)
+				continue
+			}
+			if value != nil {
+				pushStatResult(name, *value, now)
+			}
+		}
+	}
+}
+
+func (t *TSDBProxy) fetchStatsDocument(statsPath string, flatten func(interface{}) []statLeaf) ([]statLeaf, error) {
+	req, _ := http.NewRequest("GET", config.TSDBURL+statsPath, nil)
+	req.Header.Set("Accept", "application/json")
+
+	body, err := t.doHTTPRequest(req, "stats")
+	if err != nil {
+		return nil, err
+	}
+
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil, fmt.Errorf("unexpected statistics response body: %s", err)
+	}
+
+	return flatten(document), nil
+}
+
+// pushStatLeaves sums the leaves matching the paths of every statistic and pushes them. The statistics without any
+// matching leaf aren't pushed (eg: an InfluxDB without any shard yet)
+func pushStatLeaves(leaves []statLeaf, timestamp time.Time) {
+	for name, paths := range tsdbStatPaths() {
+		sum := 0.0
+		found := false
+		for _, statPath := range paths {
+			pattern := strings.Split(statPath, ".")
+			for _, leaf := range leaves {
+				if statPathMatches(pattern, leaf.path) {
+					sum += leaf.value
+					found = true
+				}
+			}
+		}
+
+		if !found {
+			log.Debugf("No TSDB statistic found for %s (%s)", name, strings.Join(paths, "+"))
+			continue
+		}
+		pushStatResult(name, sum, timestamp)
+	}
+}
+
+func statPathMatches(pattern []string, leafPath []string) bool {
+	if len(pattern) != len(leafPath) {
+		return false
+	}
+	for index := range pattern {
+		if matched, _ := path.Match(pattern[index], leafPath[index]); !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// flattenStats returns the numeric leaves of a JSON document. The libmtev statistics ({"_type": "L", "_value": 42})
+// are leaves as well
+func flattenStats(document interface{}) []statLeaf {
+	leaves := []statLeaf{}
+	flattenStatsInto(nil, document, &leaves)
+
+	return leaves
+}
+
+func flattenStatsInto(prefix []string, value interface{}, leaves *[]statLeaf) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if mtevValue, ok := v["_value"]; ok {
+			flattenStatsInto(prefix, mtevValue, leaves)
+			return
+		}
+		for key, child := range v {
+			flattenStatsInto(append(append([]string{}, prefix...), key), child, leaves)
+		}
+	default:
+		// Numbers, and the strings holding numbers (eg: 64-bit libmtev counters)
+		f := toFloat(v)
+		if len(prefix) > 0 && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			*leaves = append(*leaves, statLeaf{path: prefix, value: f})
+		}
+	}
+}
+
+// flattenInfluxDBVars returns the leaves of the InfluxDB /debug/vars document. The entries with a name and values
+// (one per shard, database, etc) are flattened as <name>.<value>, the other ones (eg: memstats) as is
+func flattenInfluxDBVars(document interface{}) []statLeaf {
+	leaves := []statLeaf{}
+
+	entries, ok := document.(map[string]interface{})
+	if !ok {
+		return leaves
+	}
+
+	for key, entry := range entries {
+		fields, isMap := entry.(map[string]interface{})
+		name, hasName := fields["name"].(string)
+		values, hasValues := fields["values"].(map[string]interface{})
+		if isMap && hasName && hasValues {
+			flattenStatsInto([]string{name}, values, &leaves)
+			continue
+		}
+
+		flattenStatsInto([]string{key}, entry, &leaves)
+	}
+
+	return leaves
+}
+
+func pushStatResult(name string, value float64, timestamp time.Time) {
+	r := dataout.Result{Timestamp: timestamp.Unix(), Name: fmt.Sprintf("%s.tsdb.stats.%s", config.SandboxID, name), Value: formatFloat(value)}
+	select {
+	case dataout.ResultChan <- r:
+	default:
+		log.Error("Channel full, discarding result")
+	}
+}
@@ -0,0 +1,168 @@
+package httpclient
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aleveille/tems/config"
+)
+
+// Names of the shared clients, used in their stats metric names (eg: http.grafana.conn.new)
+const (
+	GrafanaClient  = "grafana"
+	TSDBClient     = "tsdb"
+	CirconusClient = "circonus"
+	InfraClient    = "infra"
+	AWSClient      = "aws"
+)
+
+var (
+	statsMutex sync.Mutex
+	stats      = map[string]*clientStats{}
+)
+
+// Settings are the values specific to a client. The connection tunables shared by every client (keep-alive,
+// max conns, HTTP/2, compression) come from the config package. A non-zero config.HTTPDialTimeout overrides DialTimeout.
+type Settings struct {
+	Timeout               time.Duration
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	TLSHandshakeTimeout   time.Duration
+	// Sandbox clients present the client certificate and use the TLS server name override
+	Sandbox bool
+}
+
+// Stats are the connection stats of a client since the previous call to TakeStats()
+type Stats struct {
+	Name        string
+	Requests    int64
+	NewConns    int64
+	ReusedConns int64
+	// SetupDuration is the total time spent on DNS, TCP and TLS for the new connections
+	SetupDuration time.Duration
+}
+
+type clientStats struct {
+	requests    int64
+	newConns    int64
+	reusedConns int64
+	setupNanos  int64
+}
+
+// New creates an HTTP client whose connection reuse is tracked under the given name
+func New(name string, settings Settings) *http.Client {
+	dialTimeout := settings.DialTimeout
+	if config.HTTPDialTimeout != 0 {
+		dialTimeout = config.HTTPDialTimeout
+	}
+
+	clientTLSConfig := tlsConfig
+	if settings.Sandbox {
+		clientTLSConfig = sandboxTLSConfig
+	}
+
+	transport := &http.Transport{
+		DisableCompression:    !config.HTTPCompression,
+		DisableKeepAlives:     config.HTTPDisableKeepAlives,
+		MaxConnsPerHost:       config.HTTPMaxConnsPerHost,
+		MaxIdleConnsPerHost:   config.HTTPMaxIdleConnsPerHost,
+		IdleConnTimeout:       config.HTTPIdleConnTimeout,
+		ForceAttemptHTTP2:     config.HTTP2,
+		TLSClientConfig:       clientTLSConfig.Clone(),
+		Proxy:                 proxyFunc,
+		ResponseHeaderTimeout: settings.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   settings.TLSHandshakeTimeout,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+	}
+
+	return &http.Client{
+		Timeout:   settings.Timeout,
+		Transport: &tracingTransport{base: transport, stats: clientStatsFor(name)},
+	}
+}
+
+// StatsMetricNames returns the metric names (relative to the sandbox ID) published for the given clients
+func StatsMetricNames(names ...string) []string {
+	metricNames := []string{}
+	for _, name := range names {
+		for _, suffix := range []string{"requests", "conn.new", "conn.reused", "conn.setup.duration"} {
+			metricNames = append(metricNames, fmt.Sprintf("http.%s.%s", name, suffix))
+		}
+	}
+
+	return metricNames
+}
+
+// TakeStats returns the stats of every client and resets them
+func TakeStats() []Stats {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	snapshot := make([]Stats, 0, len(stats))
+	for name, s := range stats {
+		snapshot = append(snapshot, Stats{
+			Name:          name,
+			Requests:      atomic.SwapInt64(&s.requests, 0),
+			NewConns:      atomic.SwapInt64(&s.newConns, 0),
+			ReusedConns:   atomic.SwapInt64(&s.reusedConns, 0),
+			SetupDuration: time.Duration(atomic.SwapInt64(&s.setupNanos, 0)),
+		})
+	}
+
+	return snapshot
+}
+
+// clientStatsFor returns the stats of the named client, the clients sharing a name share their stats
+func clientStatsFor(name string) *clientStats {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	s, ok := stats[name]
+	if !ok {
+		s = &clientStats{}
+		stats[name] = s
+	}
+
+	return s
+}
+
+// tracingTransport counts the new and reused connections of every request through net/http/httptrace
+type tracingTransport struct {
+	base  http.RoundTripper
+	stats *clientStats
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.stats.requests, 1)
+
+	// The hooks can be called from the dialing goroutines, hence the atomic
+	var setupStart int64
+	markSetupStart := func() {
+		atomic.CompareAndSwapInt64(&setupStart, 0, time.Now().UnixNano())
+	}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart:     func(httptrace.DNSStartInfo) { markSetupStart() },
+		ConnectStart: func(string, string) { markSetupStart() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&t.stats.reusedConns, 1)
+				return
+			}
+			atomic.AddInt64(&t.stats.newConns, 1)
+			if start := atomic.LoadInt64(&setupStart); start != 0 {
+				atomic.AddInt64(&t.stats.setupNanos, time.Now().UnixNano()-start)
+			}
+		},
+	}
+
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
@@ -0,0 +1,93 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/aleveille/tems/config"
+	appError "github.com/aleveille/tems/error"
+	log "github.com/aleveille/tems/logger"
+)
+
+var (
+	// Set by Init(). The CA bundle and verification setting are shared by every client, the SNI override and the client
+	// certificate only go to the sandbox clients (the Circonus API is not the sandbox)
+	tlsConfig        *tls.Config
+	sandboxTLSConfig *tls.Config
+	proxyFunc        = http.ProxyFromEnvironment
+)
+
+// Init loads the TLS and outbound proxy settings. This must be called before creating any client
+func Init() error {
+	log.Debug("httpclient Init() start")
+	defer log.Debug("httpclient Init() end")
+
+	var err error
+	tlsConfig, sandboxTLSConfig, err = loadTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	if config.OutboundProxy != "" {
+		proxyURL, err := url.Parse(config.OutboundProxy)
+		if err != nil {
+			return appError.NewInitializationError("Error parsing the outbound proxy URL", err)
+		}
+		if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5" {
+			return appError.NewInitializationError(fmt.Sprintf("Unsupported outbound proxy scheme %q (http, https or socks5)", proxyURL.Scheme), nil)
+		}
+		proxyFunc = http.ProxyURL(proxyURL)
+		log.Infof("HTTP clients will go through the %s proxy %s", proxyURL.Scheme, proxyURL.Host)
+	}
+
+	return nil
+}
+
+// TLSConfig returns a copy of the TLS settings of the non-sandbox clients, for the clients not created by New()
+func TLSConfig() *tls.Config {
+	return tlsConfig.Clone()
+}
+
+func loadTLSConfig() (*tls.Config, *tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+	}
+
+	if config.TLSInsecureSkipVerify {
+		log.Warn("The HTTP clients won't verify the server certificates")
+	}
+
+	if config.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(config.TLSCAFile)
+		if err != nil {
+			return nil, nil, appError.NewInitializationError("Error reading the CA bundle", err)
+		}
+
+		// The extra CAs are trusted on top of the system ones
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, appError.NewInitializationError(fmt.Sprintf("No certificate found in the CA bundle %s", config.TLSCAFile), nil)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	sandboxTLSConfig := tlsConfig.Clone()
+	sandboxTLSConfig.ServerName = config.TLSServerName
+
+	if config.TLSClientCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.TLSClientCertFile, config.TLSClientKeyFile)
+		if err != nil {
+			return nil, nil, appError.NewInitializationError("Error loading the client certificate and key", err)
+		}
+		sandboxTLSConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, sandboxTLSConfig, nil
+}